@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"net/http"
+	"strings"
 )
 
 type fourOhFourConsumerWriter struct {
@@ -13,7 +14,8 @@ type fourOhFourConsumerWriter struct {
 
 func (w *fourOhFourConsumerWriter) WriteHeader(status int) {
 	w.statusCode = status
-	if status == http.StatusNotFound {
+	// The API's errors are already JSON.
+	if status == http.StatusNotFound && !strings.HasPrefix(w.ResponseWriter.Header().Get("Content-Type"), "application/json") {
 		w.ResponseWriter.Header().Set("Content-Type", "text/html; charset=utf-8")
 	}
 	w.ResponseWriter.WriteHeader(status)
@@ -13,6 +13,10 @@ type HealthServer struct {
 }
 
 func (h *HealthServer) IncrementMetric(key string) {
+	h.AddToMetric(key, 1)
+}
+
+func (h *HealthServer) AddToMetric(key string, n int) {
 	h.mtx.Lock()
 	defer h.mtx.Unlock()
 	if h.metrics == nil {
@@ -22,7 +26,7 @@ func (h *HealthServer) IncrementMetric(key string) {
 	if pV, ok := h.metrics[key]; ok {
 		val, ok = pV.(int)
 	}
-	val++
+	val += n
 	h.metrics[key] = val
 }
 
@@ -8,6 +8,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"sort"
 	"strings"
 	"time"
@@ -48,6 +49,16 @@ func LanguageNamed(name string) *Language {
 	return v
 }
 
+// LanguageForFilename guesses the language of a file from its extension.
+func LanguageForFilename(name string) *Language {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	v, ok := languageConfig.extensionMap[ext]
+	if !ok {
+		return unknownLanguage
+	}
+	return v
+}
+
 type _LanguageConfiguration struct {
 	LanguageGroups []*struct {
 		Name      string       `json:"name,omitempty"`
@@ -56,6 +67,7 @@ type _LanguageConfiguration struct {
 	Formatters map[string]*Formatter
 
 	languageMap        map[string]*Language
+	extensionMap       map[string]*Language
 	modtime            time.Time
 	languageJSONReader *bytes.Reader
 }
@@ -143,12 +155,19 @@ func loadLanguageConfig() {
 	}
 
 	languageConfig.languageMap = make(map[string]*Language)
+	languageConfig.extensionMap = make(map[string]*Language)
 	for _, g := range languageConfig.LanguageGroups {
 		for _, v := range g.Languages {
 			languageConfig.languageMap[v.ID] = v
 			for _, langname := range v.AlternateIDs {
 				languageConfig.languageMap[langname] = v
 			}
+			// Where languages share an extension, the first one listed gets it.
+			for _, ext := range v.Extensions {
+				if _, ok := languageConfig.extensionMap[ext]; !ok {
+					languageConfig.extensionMap[ext] = v
+				}
+			}
 		}
 		sort.Sort(g.Languages)
 	}
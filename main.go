@@ -1,6 +1,7 @@
 package main
 
 import (
+	"archive/zip"
 	"bufio"
 	"bytes"
 	"crypto/md5"
@@ -11,10 +12,13 @@ import (
 	"html/template"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -52,20 +56,80 @@ func (e PasteNotFoundError) StatusCode() int {
 	return http.StatusNotFound
 }
 
+func (e PasteModifiedError) StatusCode() int {
+	return http.StatusConflict
+}
+
 func (e PasteNotFoundError) ErrorTemplateName() string {
 	return "paste_not_found"
 }
 
+func (e PasteRevisionNotFoundError) StatusCode() int {
+	return http.StatusNotFound
+}
+
+func (e PasteRevisionNotFoundError) ErrorTemplateName() string {
+	return "paste_not_found"
+}
+
 type PasteTooLargeError ByteSize
 
 func (e PasteTooLargeError) Error() string {
 	return fmt.Sprintf("Your input (%v) exceeds the maximum paste length, which is %v.", ByteSize(e), PASTE_MAXIMUM_LENGTH)
 }
 
+func (e PasteFileNotFoundError) StatusCode() int {
+	return http.StatusNotFound
+}
+
+func (e PasteFileNotFoundError) ErrorTemplateName() string {
+	return "paste_not_found"
+}
+
+func (e PasteAttachmentNotFoundError) StatusCode() int {
+	return http.StatusNotFound
+}
+
+func (e PasteAttachmentNotFoundError) ErrorTemplateName() string {
+	return "paste_not_found"
+}
+
 func (e PasteTooLargeError) StatusCode() int {
 	return http.StatusBadRequest
 }
 
+func (e PasteStoreLimitError) StatusCode() int {
+	return http.StatusRequestEntityTooLarge
+}
+
+func (e PasteClientEncryptionError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+func (e PasteViewLimitError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+func (e PasteExpirationError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+func (e PasteVisibilityError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+func (e PastePasswordError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+func (e PasteUploadError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+func (e PasteUploadTooLargeError) StatusCode() int {
+	return http.StatusRequestEntityTooLarge
+}
+
 func getPasteJSONHandler(o Model, w http.ResponseWriter, r *http.Request) {
 	p := o.(*Paste)
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -75,19 +139,42 @@ func getPasteJSONHandler(o Model, w http.ResponseWriter, r *http.Request) {
 	buf := &bytes.Buffer{}
 	io.Copy(buf, reader)
 
+	pasteMap := pasteJSONObject(p)
+	pasteMap["body"] = string(buf.Bytes())
+
+	json, _ := json.Marshal(pasteMap)
+	w.Write(json)
+}
+
+// pasteJSONObject describes p, but not its body, for the JSON routes.
+func pasteJSONObject(p *Paste) map[string]interface{} {
 	pasteMap := map[string]interface{}{
 		"id":         p.ID,
 		"language":   p.Language,
 		"encrypted":  p.Encrypted,
 		"expiration": p.Expiration,
-		"body":       string(buf.Bytes()),
+		"visibility": p.Visibility,
 	}
-
-	json, _ := json.Marshal(pasteMap)
-	w.Write(json)
+	if len(p.Files) > 0 {
+		pasteMap["files"] = p.Files
+	}
+	if attachments, _ := p.Attachments(); len(attachments) > 0 {
+		pasteMap["attachments"] = attachments
+	}
+	if p.ClientEncryption != "" {
+		pasteMap["client_encryption"] = p.ClientEncryption
+	}
+	if !p.ExpirationTime().IsZero() {
+		pasteMap["expires_at"] = p.ExpirationTime().UTC().Format(time.RFC3339)
+	}
+	if p.MaxViews > 0 {
+		pasteMap["max_views"] = p.MaxViews
+		pasteMap["remaining_views"] = p.RemainingViews()
+	}
+	return pasteMap
 }
 
-func getPasteRawHandler(o Model, w http.ResponseWriter, r *http.Request) {
+func setRawPasteHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Origin", "null")
 	w.Header().Set("Vary", "Origin")
 
@@ -95,6 +182,10 @@ func getPasteRawHandler(o Model, w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("X-XSS-Protection", "1; mode=block")
+}
+
+func getPasteRawHandler(o Model, w http.ResponseWriter, r *http.Request) {
+	setRawPasteHeaders(w)
 
 	p := o.(*Paste)
 	ext := "txt"
@@ -114,7 +205,126 @@ func getPasteRawHandler(o Model, w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Transfer-Encoding", "binary")
 	}
 
-	reader, _ := p.Reader()
+	// ServeContent answers conditional and range requests, against the
+	// paste's ETag (set along with the route) and modification time.
+	reader, err := p.SeekableReader()
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+	http.ServeContent(w, r, "", p.LastModified(), reader)
+}
+
+func getPasteFileRawHandler(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	name := mux.Vars(r)["file"]
+	i, ok := fileNamed(p.Files, name)
+	if !ok {
+		panic(PasteFileNotFoundError{ID: p.ID, Name: name})
+	}
+
+	setRawPasteHeaders(w)
+	if mux.CurrentRoute(r).GetName() == "file_download" {
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+name+"\"")
+		w.Header().Set("Content-Transfer-Encoding", "binary")
+	}
+
+	reader, err := p.FileReader(i)
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+	io.Copy(w, reader)
+}
+
+// getPasteAttachmentHandler serves an attachment for download or, if it's an
+// image that can be, for previewing inline.
+func getPasteAttachmentHandler(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	a, err := p.Attachment(mux.Vars(r)["attachment"])
+	if err != nil {
+		panic(err)
+	}
+
+	disposition := "attachment"
+	if mux.CurrentRoute(r).GetName() == "attachment_preview" {
+		if !a.Previewable() {
+			panic(PasteAttachmentNotFoundError{ID: p.ID, Name: a.Name})
+		}
+		disposition = "inline"
+	}
+
+	reader, err := a.Reader()
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+
+	setRawPasteHeaders(w)
+	w.Header().Set("Content-Type", a.Type)
+	w.Header().Set("Content-Length", strconv.FormatInt(a.Length, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Name}))
+	io.Copy(w, reader)
+}
+
+// getPasteZipHandler bundles every file in a paste into a zip archive. A
+// single-file paste is named the same way it is when downloaded.
+func getPasteZipHandler(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+
+	basename := p.ID.String()
+	if p.Title != "" {
+		basename = p.Title
+	}
+
+	files := p.Files
+	if len(files) == 0 {
+		ext := "txt"
+		if len(p.Language.Extensions) > 0 {
+			ext = p.Language.Extensions[0]
+		}
+		files = []*PasteFile{{Name: basename + "." + ext, Language: p.Language, Length: -1}}
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+basename+".zip\"")
+
+	reader, err := p.Reader()
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Deflate, Modified: p.LastModified()})
+		if err != nil {
+			glog.Errorf("Zip for %s failed: %s", p.ID, err.Error())
+			return
+		}
+
+		var src io.Reader = reader
+		if f.Length >= 0 {
+			src = io.LimitReader(reader, f.Length)
+		}
+		if _, err := io.Copy(fw, src); err != nil {
+			glog.Errorf("Zip for %s failed: %s", p.ID, err.Error())
+			return
+		}
+	}
+	zw.Close()
+
+	healthServer.IncrementMetric("paste.zipped")
+}
+
+func getRevisionRawHandler(o Model, w http.ResponseWriter, r *http.Request) {
+	setRawPasteHeaders(w)
+
+	rev := o.(*PasteRevision)
+	reader, err := rev.Reader()
+	if err != nil {
+		panic(err)
+	}
 	defer reader.Close()
 	io.Copy(w, reader)
 }
@@ -139,21 +349,34 @@ func pasteGrantHandler(o Model, w http.ResponseWriter, r *http.Request) {
 
 func pasteUngrantHandler(o Model, w http.ResponseWriter, r *http.Request) {
 	p := o.(*Paste)
-	perms := GetPastePermissions(r)
-	perms.Delete(p.ID)
-	perms.Save(w, r)
+	disavowPaste(p, w, r)
 
 	SetFlash(w, "success", fmt.Sprintf("Paste %v disavowed.", p.ID))
 	w.Header().Set("Location", pasteURL("show", &Paste{ID: p.ID}))
 	w.WriteHeader(http.StatusSeeOther)
+}
+
+// disavowPaste gives up the requester's rights to p, including its account's
+// ownership of it.
+func disavowPaste(p *Paste, w http.ResponseWriter, r *http.Request) {
+	perms := GetPastePermissions(r)
+	perms.Delete(p.ID)
+	perms.Save(w, r)
+
+	// Otherwise the account would go on owning it.
+	if isPasteOwner(p, r) {
+		p.Owner = ""
+		if err := p.Save(); err != nil {
+			panic(err)
+		}
+	}
 
 	healthServer.IncrementMetric("grants.disavowed")
 }
 
 func grantAcceptHandler(w http.ResponseWriter, r *http.Request) {
 	v := mux.Vars(r)
-	grantKey := GrantID(v["grantkey"])
-	pID, ok := grantStore.Get(grantKey)
+	pID, ok := acceptGrant(GrantID(v["grantkey"]), w, r)
 	if !ok {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusUnauthorized)
@@ -161,6 +384,19 @@ func grantAcceptHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	SetFlash(w, "success", fmt.Sprintf("You now have edit rights to Paste %v.", pID))
+	w.Header().Set("Location", pasteURL("show", &Paste{ID: pID}))
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// acceptGrant gives the requester edit rights to the paste grantKey was made
+// for, and uses the grant up. It reports false if there's no such grant.
+func acceptGrant(grantKey GrantID, w http.ResponseWriter, r *http.Request) (PasteID, bool) {
+	pID, ok := grantStore.Get(grantKey)
+	if !ok {
+		return pID, false
+	}
+
 	perms := GetPastePermissions(r)
 	perms.Put(pID, PastePermission{"edit": true})
 	perms.Save(w, r)
@@ -168,14 +404,15 @@ func grantAcceptHandler(w http.ResponseWriter, r *http.Request) {
 	// delete(grants, grantKey)
 	grantStore.Delete(grantKey)
 
-	SetFlash(w, "success", fmt.Sprintf("You now have edit rights to Paste %v.", pID))
-	w.Header().Set("Location", pasteURL("show", &Paste{ID: pID}))
-	w.WriteHeader(http.StatusSeeOther)
-
 	healthServer.IncrementMetric("grants.accepted")
+	return pID, true
 }
 
 func isEditAllowed(p *Paste, r *http.Request) bool {
+	if isPasteOwner(p, r) {
+		return true
+	}
+
 	perms := GetPastePermissions(r)
 	perm, ok := perms.Get(p.ID)
 	if !ok {
@@ -198,20 +435,215 @@ func requiresEditPermission(fn ModelRenderFunc) ModelRenderFunc {
 	}
 }
 
+// isOwnerAllowed reports whether the requester created p (or forked it), as
+// opposed to having been granted the right to edit it.
+func isOwnerAllowed(p *Paste, r *http.Request) bool {
+	if isPasteOwner(p, r) {
+		return true
+	}
+
+	perms := GetPastePermissions(r)
+	perm, ok := perms.Get(p.ID)
+	if !ok {
+		return false
+	}
+
+	return perm["grant"]
+}
+
+// requiresOwnerPermission wraps a handler that only a paste's creator may
+// use; action describes it for the error anybody else gets.
+func requiresOwnerPermission(action string, fn ModelRenderFunc) ModelRenderFunc {
+	return func(o Model, w http.ResponseWriter, r *http.Request) {
+		defer errorRecoveryHandler(w)
+
+		p := o.(*Paste)
+		accerr := PasteAccessDeniedError{action, p.ID}
+		if !isOwnerAllowed(p, r) {
+			panic(accerr)
+		}
+		fn(p, w, r)
+	}
+}
+
+// sendsETag wraps a handler that shows a paste, naming the version it shows
+// so that edits can be made against it.
+func sendsETag(fn ModelRenderFunc) ModelRenderFunc {
+	return func(o Model, w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", o.(*Paste).ETag())
+		fn(o, w, r)
+	}
+}
+
+// burnsAfterReading wraps a handler that reveals one or more pastes. Any of
+// them that burn after reading are shown only to the first request from
+// somebody other than their creator, and destroyed once they've been shown.
+// Views of those limited to a number of views are counted, and they're
+// destroyed once the last has been shown. Only a response sent in full (a
+// 200) counts as having shown them.
+func burnsAfterReading(fn ModelRenderFunc) ModelRenderFunc {
+	return func(o Model, w http.ResponseWriter, r *http.Request) {
+		defer errorRecoveryHandler(w)
+
+		revealPastes(o, r, func() bool {
+			sw := &statusRecordingWriter{ResponseWriter: w}
+			fn(o, sw, r)
+			return sw.status == http.StatusOK
+		})
+	}
+}
+
+// statusRecordingWriter remembers the status a handler answered with.
+type statusRecordingWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// servesPasteBody wraps a handler that serves a paste's body with
+// http.ServeContent. HEAD requests, and conditional ones that the client's
+// copy is still good for, are answered before burnsAfterReading gets a look
+// in, as they don't show the paste and mustn't burn it or count as a view.
+// A paste that would be burned or counted is only ever sent whole, never as
+// a range.
+func servesPasteBody(fn ModelRenderFunc) ModelRenderFunc {
+	reveal := burnsAfterReading(fn)
+	return func(o Model, w http.ResponseWriter, r *http.Request) {
+		defer errorRecoveryHandler(w)
+
+		p := o.(*Paste)
+		if r.Method == "HEAD" || pasteNotModified(p, r) {
+			fn(o, w, r)
+			return
+		}
+		if (p.BurnsAfterReading() || p.MaxViews > 0) && !isOwnerAllowed(p, r) {
+			r.Header.Del("Range")
+		}
+		reveal(o, w, r)
+	}
+}
+
+// pasteNotModified reports whether r's conditions say that its client already
+// has p as it is, as http.ServeContent would judge them.
+func pasteNotModified(p *Paste, r *http.Request) bool {
+	if tags := r.Header.Get("If-None-Match"); tags != "" {
+		return etagMatches(tags, p.ETag())
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !p.LastModified().Truncate(time.Second).After(since)
+}
+
+// revealPastes calls reveal to show the pastes in o to r, burning and
+// counting views of them as burnsAfterReading describes. reveal reports
+// whether it showed them; if it didn't, none are burned and their views are
+// given back.
+func revealPastes(o Model, r *http.Request, reveal func() bool) {
+	var burning, limited []*Paste
+	for _, p := range pastesInModel(o) {
+		if isOwnerAllowed(p, r) {
+			continue
+		}
+		if p.BurnsAfterReading() {
+			burning = append(burning, p)
+		} else if p.MaxViews > 0 {
+			limited = append(limited, p)
+		}
+	}
+
+	for i, p := range burning {
+		if !claimBurn(p.ID) {
+			for _, claimed := range burning[:i] {
+				releaseBurn(claimed.ID)
+			}
+			panic(PasteNotFoundError{ID: p.ID})
+		}
+	}
+	defer func() {
+		for _, p := range burning {
+			releaseBurn(p.ID)
+		}
+	}()
+
+	// Somebody else may have read (and burned) the paste between our
+	// looking it up and claiming it.
+	for _, p := range burning {
+		if _, err := pasteStore.Get(p.ID, nil); err != nil {
+			if _, ok := err.(PasteNotFoundError); ok {
+				panic(err)
+			}
+		}
+	}
+
+	shown := false
+	for _, p := range limited {
+		endView, err := beginLimitedView(p)
+		if err != nil {
+			panic(err)
+		}
+		defer func() {
+			endView(shown)
+		}()
+	}
+
+	if shown = reveal(); !shown {
+		return
+	}
+
+	for _, p := range burning {
+		if err := p.Destroy(); err != nil {
+			glog.Errorf("Failed to burn paste %v: %v", p.ID, err)
+			continue
+		}
+		healthServer.IncrementMetric("paste.burned")
+	}
+}
+
+// confirmsBurn shows a paste that burns after reading only once its reader
+// has confirmed that they want to read it, so that link previews and the like
+// don't burn it on their behalf.
+func confirmsBurn(fn ModelRenderFunc) ModelRenderFunc {
+	return func(o Model, w http.ResponseWriter, r *http.Request) {
+		p := o.(*Paste)
+		if p.BurnsAfterReading() && !isOwnerAllowed(p, r) && r.FormValue("reveal") == "" {
+			RenderPage(w, r, "paste_burn_confirm", p)
+			return
+		}
+		fn(p, w, r)
+	}
+}
+
+// isUserAllowed reports whether the requester is signed in to an account
+// that has permission.
+func isUserAllowed(permission string, r *http.Request) bool {
+	user := GetUser(r)
+	if user == nil {
+		return false
+	}
+
+	perms, ok := user.Values["user.permissions"].(PastePermission)
+	return ok && perms[permission]
+}
+
 func requiresUserPermission(permission string, handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer errorRecoveryHandler(w)
 
-		user := GetUser(r)
-		if user != nil {
-			if o, ok := user.Values["user.permissions"]; ok {
-				if perms, ok := o.(PastePermission); ok {
-					if perms[permission] {
-						handler.ServeHTTP(w, r)
-						return
-					}
-				}
-			}
+		if isUserAllowed(permission, r) {
+			handler.ServeHTTP(w, r)
+			return
 		}
 
 		healthServer.IncrementMetric("permission." + permission + ".failed")
@@ -224,9 +656,57 @@ func pasteUpdate(o Model, w http.ResponseWriter, r *http.Request) {
 	healthServer.IncrementMetric("paste.updated")
 }
 
+// pasteBodyFromRequest assembles a paste's body from a submitted form. More
+// than one "text" field makes a multi-file paste, with each file's name and
+// language in the "filename" and "lang" fields at the same position. Blank
+// files are dropped.
+func pasteBodyFromRequest(r *http.Request) (string, []*PasteFile) {
+	body := r.FormValue("text")
+	texts := r.Form["text"]
+	if len(texts) < 2 {
+		return body, nil
+	}
+	return pasteBodyFromFiles(texts, r.Form["filename"], r.Form["lang"])
+}
+
+// pasteBodyFromFiles joins texts into the body of a multi-file paste, naming
+// each file and choosing its language from names and langs at the same
+// position. Blank files are dropped.
+func pasteBodyFromFiles(texts, names, langs []string) (string, []*PasteFile) {
+	taken := make(map[string]bool)
+	var files []*PasteFile
+	buf := &bytes.Buffer{}
+	for i, text := range texts {
+		if len(strings.TrimSpace(text)) == 0 {
+			continue
+		}
+
+		lang := unknownLanguage
+		if i < len(langs) && langs[i] != "" {
+			lang = LanguageNamed(langs[i])
+		}
+
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+
+		files = append(files, &PasteFile{Name: pasteFileName(name, len(files), lang, taken), Language: lang, Length: int64(len(text))})
+		buf.WriteString(text)
+	}
+	return buf.String(), files
+}
+
 func pasteUpdateCore(o Model, w http.ResponseWriter, r *http.Request, newPaste bool) {
 	p := o.(*Paste)
-	body := r.FormValue("text")
+	body, files := pasteBodyFromRequest(r)
+
+	base := pasteEditBase(r)
+	if !newPaste && base != "" && !etagMatches(base, p.ETag()) {
+		renderPasteConflict(NewPasteConflict(p, base, unsavedPasteEdit(p, r, body, files), r.PostForm), pasteConflictStatus(r), w, r)
+		return
+	}
+
 	if len(strings.TrimSpace(body)) == 0 {
 		w.Header().Set("Location", pasteURL("delete", p))
 		w.WriteHeader(http.StatusFound)
@@ -238,6 +718,27 @@ func pasteUpdateCore(o Model, w http.ResponseWriter, r *http.Request, newPaste b
 		panic(PasteTooLargeError(pasteLen))
 	}
 
+	// A paste is either encrypted by the client for its whole life, or never.
+	clientEncryption := r.FormValue("client_encryption")
+	if clientEncryption != p.ClientEncryption {
+		panic(PasteClientEncryptionError("Client-side encryption can't be turned on or off once a paste exists."))
+	}
+	if err := checkClientEncryption(clientEncryption, body, files); err != nil {
+		panic(err)
+	}
+
+	if v := r.FormValue("visibility"); v != "" || newPaste {
+		visibility, err := parsePasteVisibility(v)
+		if err != nil {
+			panic(err)
+		}
+		p.Visibility = visibility
+	}
+
+	if err := updatePasteExpiration(p, r.FormValue("expire"), r.FormValue("expire_at"), newPaste); err != nil {
+		panic(err)
+	}
+
 	if !newPaste {
 		// If this is an update (instead of a new paste), blow away the hash.
 		tok := "P|H|" + p.ID.String()
@@ -248,41 +749,64 @@ func pasteUpdateCore(o Model, w http.ResponseWriter, r *http.Request, newPaste b
 		}
 	}
 
-	pw, _ := p.Writer()
-	pw.Write([]byte(body))
-	if r.FormValue("lang") != "" {
-		p.Language = LanguageNamed(r.FormValue("lang"))
+	// Somebody else may yet save over the version the edit was made against.
+	base, edit := p.ETag(), unsavedPasteEdit(p, r, body, files)
+
+	pw, err := p.Writer()
+	if err != nil {
+		panic(err)
+	}
+	if _, err := pw.Write([]byte(body)); err != nil {
+		pw.Abort()
+		panic(err)
+	}
+	if files != nil {
+		// The paste as a whole takes on the language of its first file.
+		p.Language = files[0].Language
+		p.Files = nil
+		if len(files) > 1 {
+			p.Files = files
+		}
+	} else {
+		p.Files = nil
+		if r.FormValue("lang") != "" {
+			p.Language = LanguageNamed(r.FormValue("lang"))
+		}
 	}
 
 	if p.Language == nil {
 		p.Language = unknownLanguage
 	}
 
-	expireIn := r.FormValue("expire")
-	if expireIn != "" && expireIn != "-1" {
-		dur, _ := ParseDuration(expireIn)
-		if dur > MAX_EXPIRE_DURATION {
-			dur = MAX_EXPIRE_DURATION
-		}
-		pasteExpirator.ExpireObject(p, dur)
-	} else {
-		if expireIn == "-1" && pasteExpirator.ObjectHasExpiration(p) {
-			pasteExpirator.CancelObjectExpiration(p)
-		}
+	// The real title and language are encrypted along with the body.
+	title := r.FormValue("title")
+	if p.ClientEncryption != "" {
+		p.Language, title = LanguageNamed("text"), ""
 	}
 
-	p.Expiration = expireIn
+	p.Title = title
 
-	p.Title = r.FormValue("title")
+	if err := pw.Close(); err != nil { // Saves p
+		if _, ok := err.(PasteModifiedError); !ok || newPaste {
+			panic(err)
+		}
 
-	pw.Close() // Saves p
+		current, err := lookupPasteWithID(r, p.ID)
+		if err != nil {
+			panic(err)
+		}
+		renderPasteConflict(NewPasteConflict(current.(*Paste), base, edit, r.PostForm), pasteConflictStatus(r), w, r)
+		return
+	}
 
 	w.Header().Set("Location", pasteURL("show", p))
 	w.WriteHeader(http.StatusSeeOther)
 }
 
 func pasteCreate(w http.ResponseWriter, r *http.Request) {
-	body := r.FormValue("text")
+	defer errorRecoveryHandler(w)
+
+	body, files := pasteBodyFromRequest(r)
 	if len(strings.TrimSpace(body)) == 0 {
 		// 400 here, 200 above (one is displayed to the user, one could be an API response.)
 		RenderError(fmt.Errorf("Hey, put some text in that paste."), 400, w)
@@ -296,75 +820,287 @@ func pasteCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	password := r.FormValue("password")
-	encrypted := password != ""
-
-	if encrypted && (Env() != EnvironmentDevelopment && !RequestIsHTTPS(r)) {
-		RenderError(fmt.Errorf("I refuse to accept passwords over HTTP."), 400, w)
-		return
+	password := r.FormValue("password")
+	encrypted := password != ""
+
+	if encrypted && (Env() != EnvironmentDevelopment && !RequestIsHTTPS(r)) {
+		RenderError(fmt.Errorf("I refuse to accept passwords over HTTP."), 400, w)
+		return
+	}
+
+	clientEncryption := r.FormValue("client_encryption")
+	if err := checkClientEncryption(clientEncryption, body, files); err != nil {
+		RenderError(err, 400, w)
+		return
+	}
+
+	if encrypted && clientEncryption != "" {
+		RenderError(fmt.Errorf("A paste can't have a password and be encrypted by the client."), 400, w)
+		return
+	}
+
+	maxViews, err := parseMaxViews(r.FormValue("max_views"))
+	if err != nil {
+		RenderError(err, 400, w)
+		return
+	}
+
+	// Handing a view-limited paste back to somebody resubmitting it would
+	// hand them its view count, too.
+	dedupe := !encrypted && clientEncryption == "" && maxViews == 0
+
+	hasher := md5.New()
+	io.WriteString(hasher, body)
+	hashToken := "H|" + SourceIPForRequest(r) + "|" + base32Encoder.EncodeToString(hasher.Sum(nil))
+
+	if dedupe {
+		v, _ := ephStore.Get(hashToken)
+		if hashedPaste, ok := v.(*Paste); ok {
+			pasteUpdateCore(hashedPaste, w, r, true)
+			return
+		}
+	}
+
+	p, err := pasteStore.New(password != "")
+	if err != nil {
+		panic(err)
+	}
+
+	if dedupe {
+		ephStore.Put(hashToken, p, 5*time.Minute)
+		ephStore.Put("P|H|"+p.ID.String(), hashToken, 5*time.Minute)
+	}
+
+	key := p.EncryptionKeyWithPassword(password)
+	p.SetEncryptionKey(key)
+	p.ClientEncryption = clientEncryption
+	p.MaxViews = maxViews
+	p.Owner = requestOwner(r)
+
+	perms := GetPastePermissions(r)
+	perms.Put(p.ID, PastePermission{"edit": true, "grant": true})
+	perms.Save(w, r)
+
+	if key != nil {
+		rememberPasteKey(r, p.ID, key)
+	}
+
+	err = sessions.Save(r, w)
+	if err != nil {
+		glog.Errorln(err)
+	}
+
+	pasteUpdateCore(p, w, r, true)
+
+	healthServer.IncrementMetric("paste.created")
+}
+
+// pasteFork reveals p as burnsAfterReading would, but counts the fork as
+// having shown it even though it answers with a redirect: a fork burns the
+// paste, or uses up a view of it, like any other read.
+func pasteFork(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	revealPastes(p, r, func() bool {
+		fork := forkPaste(p, w, r)
+
+		SetFlash(w, "success", fmt.Sprintf("Paste %v forked.", p.ID))
+		w.Header().Set("Location", pasteURL("edit", fork))
+		w.WriteHeader(http.StatusSeeOther)
+		return true
+	})
+}
+
+// forkPaste copies p into a new paste that the requester can edit. A fork of
+// an encrypted paste shares its salt and key, and so its password.
+func forkPaste(p *Paste, w http.ResponseWriter, r *http.Request) *Paste {
+	fork, err := pasteStore.New(p.Encrypted)
+	if err != nil {
+		panic(err)
+	}
+
+	if p.Encrypted {
+		fork.encryptionSalt = p.encryptionSalt
+		fork.SetEncryptionKey(p.encryptionKey)
+	}
+
+	fork.Language = p.Language
+	fork.Title = p.Title
+	fork.Files = p.Files
+	fork.Parent = p.ID
+	fork.ClientEncryption = p.ClientEncryption
+	fork.Owner = requestOwner(r)
+	fork.Visibility = p.Visibility
+
+	reader, err := p.Reader()
+	if err != nil {
+		panic(err)
+	}
+	defer reader.Close()
+
+	pw, err := fork.Writer()
+	if err != nil {
+		panic(err)
+	}
+	if _, err := io.Copy(pw, reader); err != nil {
+		pw.Abort()
+		panic(err)
+	}
+	if err := pw.Close(); err != nil { // Saves fork
+		panic(err)
+	}
+
+	perms := GetPastePermissions(r)
+	perms.Put(fork.ID, PastePermission{"edit": true, "grant": true})
+	perms.Save(w, r)
+
+	if fork.Encrypted {
+		rememberPasteKey(r, fork.ID, fork.encryptionKey)
+	}
+
+	err = sessions.Save(r, w)
+	if err != nil {
+		glog.Errorln(err)
+	}
+
+	healthServer.IncrementMetric("paste.forked")
+	return fork
+}
+
+// pasteExpirationChange puts off the expiration of a paste by the duration in
+// extend, or cancels it altogether if cancel is set.
+func pasteExpirationChange(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	changePasteExpiration(p, r.FormValue("extend"), r.FormValue("cancel") != "")
+
+	if p.ExpirationTime().IsZero() {
+		SetFlash(w, "success", fmt.Sprintf("Paste %v will no longer expire.", p.ID))
+	} else {
+		SetFlash(w, "success", fmt.Sprintf("Paste %v will now expire at %v.", p.ID, p.ExpirationTime().Format("2006-01-02 15:04 MST")))
+	}
+	w.Header().Set("Location", pasteURL("show", p))
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// changePasteExpiration puts off p's expiration by extend, a duration, or
+// cancels it if cancel is set.
+func changePasteExpiration(p *Paste, extend string, cancel bool) {
+	if p.ExpirationTime().IsZero() {
+		panic(PasteExpirationError(fmt.Sprintf("Paste %v isn't going to expire.", p.ID)))
+	}
+
+	if cancel {
+		p.Expiration = "-1"
+		expirePasteAt(p, time.Time{})
+	} else {
+		dur, err := ParseDuration(extend)
+		if err != nil || dur <= 0 {
+			panic(PasteExpirationError("I don't understand how much longer you want that paste to last."))
+		}
+		expirePasteAt(p, p.ExpirationTime().Add(dur))
+	}
+
+	if err := p.store.storeExpiration(p); err != nil {
+		panic(err)
+	}
+	scheduleExpiration(p)
+
+	if p.ExpirationTime().IsZero() {
+		healthServer.IncrementMetric("paste.expiration.cancelled")
+	} else {
+		healthServer.IncrementMetric("paste.expiration.extended")
+	}
+}
+
+func pasteAttachmentDelete(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	a, err := p.Attachment(mux.Vars(r)["attachment"])
+	if err != nil {
+		panic(err)
+	}
+
+	if err := a.Destroy(); err != nil {
+		panic(err)
 	}
 
-	hasher := md5.New()
-	io.WriteString(hasher, body)
-	hashToken := "H|" + SourceIPForRequest(r) + "|" + base32Encoder.EncodeToString(hasher.Sum(nil))
+	healthServer.IncrementMetric("paste.attachment.deleted")
+	SetFlash(w, "success", fmt.Sprintf("%s is no longer attached to paste %v.", a.Name, p.ID))
+	w.Header().Set("Location", pasteURL("show", p))
+	w.WriteHeader(http.StatusSeeOther)
+}
 
-	if !encrypted {
-		v, _ := ephStore.Get(hashToken)
-		if hashedPaste, ok := v.(*Paste); ok {
-			pasteUpdateCore(hashedPaste, w, r, true)
-			return
-		}
-	}
+// pastePasswordChange re-encrypts a paste, and all of its revisions, under a
+// new password and salt. Leaving the password blank removes it altogether.
+func pastePasswordChange(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
 
-	p, err := pasteStore.New(password != "")
-	if err != nil {
-		panic(err)
+	password := r.FormValue("password")
+	if password != "" && password != r.FormValue("confirm") {
+		panic(PastePasswordError("Those passwords don't match."))
 	}
 
-	if !encrypted {
-		ephStore.Put(hashToken, p, 5*time.Minute)
-		ephStore.Put("P|H|"+p.ID.String(), hashToken, 5*time.Minute)
+	changePastePassword(p, password, w, r)
+
+	if p.Encrypted {
+		SetFlash(w, "success", fmt.Sprintf("Paste %v has a new password.", p.ID))
+	} else {
+		SetFlash(w, "success", fmt.Sprintf("Paste %v no longer has a password.", p.ID))
 	}
+	w.Header().Set("Location", pasteURL("show", p))
+	w.WriteHeader(http.StatusSeeOther)
+}
 
-	key := p.EncryptionKeyWithPassword(password)
-	p.SetEncryptionKey(key)
+// changePastePassword re-encrypts p under password, or decrypts it for good if
+// password is blank, and keeps its new key in the requester's session.
+func changePastePassword(p *Paste, password string, w http.ResponseWriter, r *http.Request) {
+	if !p.Encrypted {
+		panic(PastePasswordError(fmt.Sprintf("Paste %v doesn't have a password.", p.ID)))
+	}
 
-	perms := GetPastePermissions(r)
-	perms.Put(p.ID, PastePermission{"edit": true, "grant": true})
-	perms.Save(w, r)
+	if Env() != EnvironmentDevelopment && !RequestIsHTTPS(r) {
+		panic(PastePasswordError("I refuse to accept passwords over HTTP."))
+	}
 
-	if key != nil {
-		cliSession, err := clientOnlySessionStore.Get(r, "c_session")
-		if err != nil {
-			glog.Errorln(err)
-		}
-		pasteKeys, ok := cliSession.Values["paste_keys"].(map[PasteID][]byte)
-		if !ok {
-			pasteKeys = map[PasteID][]byte{}
-		}
+	salt, err := generateRandomBytes(16)
+	if err != nil {
+		panic(err)
+	}
 
-		pasteKeys[p.ID] = key
-		cliSession.Values["paste_keys"] = pasteKeys
+	key := deriveEncryptionKeyWithSalt(salt, password)
+	if err := p.ChangeEncryptionKey(key, salt); err != nil {
+		panic(err)
 	}
 
+	rememberPasteKey(r, p.ID, key)
 	err = sessions.Save(r, w)
 	if err != nil {
 		glog.Errorln(err)
 	}
 
-	pasteUpdateCore(p, w, r, true)
+	if key != nil {
+		healthServer.IncrementMetric("paste.password.changed")
+	} else {
+		healthServer.IncrementMetric("paste.password.removed")
+	}
+}
 
-	healthServer.IncrementMetric("paste.created")
+// destroyPaste destroys p and drops it from perms, which the caller has to save.
+func destroyPaste(p *Paste, perms *PastePermissionSet) error {
+	if err := p.Destroy(); err != nil {
+		return err
+	}
+
+	perms.Delete(p.ID)
+	return nil
 }
 
 func pasteDelete(o Model, w http.ResponseWriter, r *http.Request) {
 	p := o.(*Paste)
 
 	oldId := p.ID
-	p.Destroy()
-
 	perms := GetPastePermissions(r)
-	perms.Delete(oldId)
+	if err := destroyPaste(p, perms); err != nil {
+		panic(err)
+	}
 	perms.Save(w, r)
 
 	SetFlash(w, "success", fmt.Sprintf("Paste %v deleted.", oldId))
@@ -380,7 +1116,12 @@ func pasteDelete(o Model, w http.ResponseWriter, r *http.Request) {
 }
 
 func lookupPasteWithRequest(r *http.Request) (Model, error) {
-	id := PasteIDFromString(mux.Vars(r)["id"])
+	return lookupPasteWithID(r, PasteIDFromString(mux.Vars(r)["id"]))
+}
+
+// lookupPasteWithID fetches any paste the request can read, decrypting it with
+// a key from the client's session if it has one.
+func lookupPasteWithID(r *http.Request, id PasteID) (Model, error) {
 	var key []byte
 
 	cliSession, err := clientOnlySessionStore.Get(r, "c_session")
@@ -395,6 +1136,10 @@ func lookupPasteWithRequest(r *http.Request) (Model, error) {
 
 	enc := false
 	p, err := pasteStore.Get(id, key)
+	if p != nil && !isPasteVisible(p, r) {
+		return nil, PasteNotFoundError{ID: id}
+	}
+
 	if _, ok := err.(PasteEncryptedError); ok {
 		enc = true
 	}
@@ -416,29 +1161,160 @@ func lookupPasteWithRequest(r *http.Request) (Model, error) {
 	return p, err
 }
 
+// rememberPasteKey keeps key in the client's session, so that the paste it
+// decrypts can be read again without its password; a nil key forgets it. The
+// caller has to save the session.
+func rememberPasteKey(r *http.Request, id PasteID, key []byte) {
+	cliSession, err := clientOnlySessionStore.Get(r, "c_session")
+	if err != nil {
+		glog.Errorln(err)
+	}
+	pasteKeys, ok := cliSession.Values["paste_keys"].(map[PasteID][]byte)
+	if !ok {
+		pasteKeys = map[PasteID][]byte{}
+	}
+
+	if key != nil {
+		pasteKeys[id] = key
+	} else {
+		delete(pasteKeys, id)
+	}
+	cliSession.Values["paste_keys"] = pasteKeys
+}
+
+func lookupPasteRevisionWithRequest(r *http.Request) (Model, error) {
+	o, err := lookupPasteWithRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p := o.(*Paste)
+	n, err := strconv.Atoi(mux.Vars(r)["rev"])
+	if err != nil {
+		return nil, PasteRevisionNotFoundError{ID: p.ID}
+	}
+	return p.Revision(n)
+}
+
+// lookupPasteDiffWithRequest compares the paste in the URL with another
+// paste, which the request must also be able to read.
+func lookupPasteDiffWithRequest(r *http.Request) (Model, error) {
+	o, err := lookupPasteWithRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	other, err := lookupPasteWithID(r, PasteIDFromString(mux.Vars(r)["other"]))
+	if err != nil {
+		return nil, err
+	}
+
+	if o.(*Paste).ClientEncryption != "" || other.(*Paste).ClientEncryption != "" {
+		return nil, PasteClientEncryptionError("Client-encrypted pastes can't be compared on the server.")
+	}
+
+	return NewPasteDiff(&PasteDiffSide{Paste: o.(*Paste)}, &PasteDiffSide{Paste: other.(*Paste)})
+}
+
+func lookupRevisionDiffWithRequest(r *http.Request) (Model, error) {
+	o, err := lookupPasteRevisionWithRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	rev := o.(*PasteRevision)
+	if rev.Paste().ClientEncryption != "" {
+		return nil, PasteClientEncryptionError("Client-encrypted pastes can't be compared on the server.")
+	}
+
+	n, err := strconv.Atoi(mux.Vars(r)["other"])
+	if err != nil {
+		return nil, PasteRevisionNotFoundError{ID: rev.Paste().ID}
+	}
+	other, err := rev.Paste().Revision(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewPasteDiff(&PasteDiffSide{Paste: rev.Paste(), Revision: rev}, &PasteDiffSide{Paste: rev.Paste(), Revision: other})
+}
+
 func pasteURL(routeType string, p *Paste) string {
-	url, _ := pasteRouter.Get(routeType).URL("id", p.ID.String())
+	return pasteURLForID(routeType, p.ID)
+}
+
+func pasteURLForID(routeType string, id PasteID) string {
+	url, _ := pasteRouter.Get(routeType).URL("id", id.String())
 	return url.String()
 }
 
-func sessionHandler(w http.ResponseWriter, r *http.Request) {
-	var pastes []*Paste
-	var ids []string
+func pasteFileURL(routeType string, p *Paste, name string) string {
+	url, _ := pasteRouter.Get(routeType).URL("id", p.ID.String(), "file", name)
+	return url.String()
+}
+
+func pasteAttachmentURL(routeType string, p *Paste, name string) string {
+	url, _ := pasteRouter.Get(routeType).URL("id", p.ID.String(), "attachment", name)
+	return url.String()
+}
+
+func pasteDiffURL(old, new PasteID) string {
+	url, _ := pasteRouter.Get("diff").URL("id", old.String(), "other", new.String())
+	return url.String()
+}
+
+func revisionURL(routeType string, rev *PasteRevision) string {
+	url, _ := pasteRouter.Get(routeType).URL("id", rev.Paste().ID.String(), "rev", strconv.Itoa(rev.Number))
+	return url.String()
+}
+
+// revisionChangesURL links to the diff between rev and the revision before it.
+func revisionChangesURL(rev *PasteRevision) string {
+	url, _ := pasteRouter.Get("revision_diff").URL("id", rev.Paste().ID.String(), "rev", strconv.Itoa(rev.Number-1), "other", strconv.Itoa(rev.Number))
+	return url.String()
+}
+
+// sessionPastes returns every paste r can edit or owns, newest first.
+func sessionPastes(r *http.Request) []*Paste {
 	perms := GetPastePermissions(r)
-	pastes = make([]*Paste, len(perms.Entries))
-	ids = make([]string, len(perms.Entries))
-	n := 0
+	pastes := make([]*Paste, 0, len(perms.Entries))
+	listed := make(map[PasteID]bool)
 	for k, _ := range perms.Entries {
 		if obj, _ := pasteStore.Get(k, nil); obj != nil {
-			pastes[n] = obj
-			ids[n] = obj.ID.String()
-			n++
+			pastes = append(pastes, obj)
+			listed[obj.ID] = true
+		}
+	}
+
+	if owner := requestOwner(r); owner != "" {
+		for _, p := range ownedPastes(owner) {
+			if !listed[p.ID] {
+				pastes = append(pastes, p)
+			}
 		}
 	}
-	pastes = pastes[:n]
-	ids = ids[:n]
+
+	sort.SliceStable(pastes, func(i, j int) bool {
+		return pastes[i].LastModified().After(pastes[j].LastModified())
+	})
+	return pastes
+}
+
+// sessionHandler lists the pastes this session can edit and, if it's signed
+// in, every paste its account owns; under /session/search, only those that
+// match the query in q.
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	pastes := sessionPastes(r)
+	if q := ParsePasteSearchQuery(r.FormValue("q")); !q.Empty() {
+		pastes = pasteIndex.Search(pastes, q)
+		healthServer.IncrementMetric("session.searched")
+	}
 
 	if strings.HasSuffix(r.URL.Path, "/raw") {
+		ids := make([]string, len(pastes))
+		for i, p := range pastes {
+			ids[i] = p.ID.String()
+		}
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.Write([]byte(strings.Join(ids, " ")))
 	} else {
@@ -456,6 +1332,9 @@ func authenticatePastePOSTHandler(w http.ResponseWriter, r *http.Request) {
 	password := r.FormValue("password")
 
 	p, err := pasteStore.Get(id, nil)
+	if p != nil && !isPasteVisible(p, r) {
+		p, err = nil, PasteNotFoundError{ID: id}
+	}
 	if p == nil {
 		RenderError(err, http.StatusNotFound, w)
 		return
@@ -463,14 +1342,7 @@ func authenticatePastePOSTHandler(w http.ResponseWriter, r *http.Request) {
 
 	key := p.EncryptionKeyWithPassword(password)
 	if key != nil {
-		cliSession, _ := clientOnlySessionStore.Get(r, "c_session")
-		pasteKeys, ok := cliSession.Values["paste_keys"].(map[PasteID][]byte)
-		if !ok {
-			pasteKeys = map[PasteID][]byte{}
-		}
-
-		pasteKeys[id] = key
-		cliSession.Values["paste_keys"] = pasteKeys
+		rememberPasteKey(r, id, key)
 		sessions.Save(r, w)
 		if err != nil {
 			glog.Errorln(err)
@@ -547,13 +1419,37 @@ var renderCache struct {
 	c  *lru.Cache
 }
 
+type pasteFileRenderKey struct {
+	ID   PasteID
+	File int
+}
+
 func renderPaste(p *Paste) template.HTML {
+	return renderCached(p, p.ID, func() (string, error) {
+		return FormatPaste(p)
+	})
+}
+
+func renderPasteFile(p *Paste, i int) template.HTML {
+	return renderCached(p, pasteFileRenderKey{p.ID, i}, func() (string, error) {
+		reader, err := p.FileReader(i)
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+		return FormatStream(reader, p.Files[i].Language)
+	})
+}
+
+// renderCached formats (some part of) p, sharing the rendered result between
+// requests until p changes. Encrypted pastes are never cached.
+func renderCached(p *Paste, key lru.Key, format func() (string, error)) template.HTML {
 	renderCache.mu.RLock()
 	var cached *RenderedPaste
 	var cval interface{}
 	var ok bool
 	if renderCache.c != nil {
-		if cval, ok = renderCache.c.Get(p.ID); ok {
+		if cval, ok = renderCache.c.Get(key); ok {
 			cached = cval.(*RenderedPaste)
 		}
 	}
@@ -562,7 +1458,7 @@ func renderPaste(p *Paste) template.HTML {
 	if !ok || cached.renderTime.Before(p.LastModified()) {
 		defer renderCache.mu.Unlock()
 		renderCache.mu.Lock()
-		out, err := FormatPaste(p)
+		out, err := format()
 
 		if err != nil {
 			glog.Errorf("Render for %s failed: (%s) output: %s", p.ID, err.Error(), out)
@@ -579,8 +1475,8 @@ func renderPaste(p *Paste) template.HTML {
 					},
 				}
 			}
-			renderCache.c.Add(p.ID, &RenderedPaste{body: rendered, renderTime: time.Now()})
-			glog.Info("RENDER CACHE: Cached ", p.ID)
+			renderCache.c.Add(key, &RenderedPaste{body: rendered, renderTime: time.Now()})
+			glog.Info("RENDER CACHE: Cached ", key)
 		}
 
 		return rendered
@@ -589,7 +1485,84 @@ func renderPaste(p *Paste) template.HTML {
 	}
 }
 
+// renderRevision formats a single revision of a paste. Revisions aren't cached;
+// they're rarely viewed compared to the paste itself.
+func renderRevision(rev *PasteRevision) template.HTML {
+	reader, err := rev.Reader()
+	if err != nil {
+		glog.Errorf("Render for %s revision %d failed: %s", rev.Paste().ID, rev.Number, err.Error())
+		return template.HTML("There was an error rendering this revision.")
+	}
+	defer reader.Close()
+
+	out, err := FormatStream(reader, rev.Language)
+	if err != nil {
+		glog.Errorf("Render for %s revision %d failed: (%s) output: %s", rev.Paste().ID, rev.Number, err.Error(), out)
+		return template.HTML("There was an error rendering this revision.")
+	}
+	return template.HTML(out)
+}
+
+func renderRevisionFile(rev *PasteRevision, i int) template.HTML {
+	reader, err := rev.FileReader(i)
+	if err != nil {
+		glog.Errorf("Render for %s revision %d failed: %s", rev.Paste().ID, rev.Number, err.Error())
+		return template.HTML("There was an error rendering this revision.")
+	}
+	defer reader.Close()
+
+	out, err := FormatStream(reader, rev.Files[i].Language)
+	if err != nil {
+		glog.Errorf("Render for %s revision %d failed: (%s) output: %s", rev.Paste().ID, rev.Number, err.Error(), out)
+		return template.HTML("There was an error rendering this revision.")
+	}
+	return template.HTML(out)
+}
+
+// editorFile is a file as it's laid out in the paste editor.
+type editorFile struct {
+	Name     string
+	Language string
+	Body     string
+}
+
+// editorFiles lays out the paste o (nil for a new one) for editing, in at
+// least one file.
+func editorFiles(o interface{}) []editorFile {
+	p, _ := o.(*Paste)
+	if p == nil {
+		return []editorFile{{}}
+	}
+
+	if len(p.Files) == 0 {
+		reader, _ := p.Reader()
+		defer reader.Close()
+		b := &bytes.Buffer{}
+		io.Copy(b, reader)
+		return []editorFile{{Language: p.Language.ID, Body: b.String()}}
+	}
+
+	files := make([]editorFile, len(p.Files))
+	for i, f := range p.Files {
+		reader, _ := p.FileReader(i)
+		b := &bytes.Buffer{}
+		io.Copy(b, reader)
+		reader.Close()
+		files[i] = editorFile{Name: f.Name, Language: f.Language.ID, Body: b.String()}
+	}
+	return files
+}
+
+func pasteUpdateCallback(p *Paste) {
+	pasteIndex.Update(p)
+	pasteListing.Update(p)
+	scheduleExpiration(p)
+}
+
 func pasteDestroyCallback(p *Paste) {
+	pasteIndex.Remove(p)
+	pasteListing.Remove(p)
+
 	tok := "P|H|" + p.ID.String()
 	v, _ := ephStore.Get(tok)
 	if hash, ok := v.(string); ok {
@@ -599,6 +1572,10 @@ func pasteDestroyCallback(p *Paste) {
 
 	pasteExpirator.CancelObjectExpiration(p)
 
+	reportStore.Delete(p.ID)
+
+	healthServer.IncrementMetric("paste.deleted")
+
 	defer renderCache.mu.Unlock()
 	renderCache.mu.Lock()
 	if renderCache.c == nil {
@@ -608,13 +1585,12 @@ func pasteDestroyCallback(p *Paste) {
 	glog.Info("RENDER CACHE: Removing ", p.ID, " due to destruction.")
 	// Clear the cached render when a paste is destroyed
 	renderCache.c.Remove(p.ID)
-
-	reportStore.Delete(p.ID)
-
-	healthServer.IncrementMetric("paste.deleted")
+	for i := range p.Files {
+		renderCache.c.Remove(pasteFileRenderKey{p.ID, i})
+	}
 }
 
-var pasteStore *FilesystemPasteStore
+var pasteStore PasteStore
 var pasteExpirator *gotimeout.Expirator
 var sessionStore *sessions.FilesystemStore
 var clientOnlySessionStore *sessions.CookieStore
@@ -622,12 +1598,22 @@ var clientLongtermSessionStore *sessions.CookieStore
 var ephStore *gotimeout.Map
 var userStore account.AccountStore
 var pasteRouter *mux.Router
+var apiRouter *mux.Router
 var router *mux.Router
 var healthServer *HealthServer
 
 type args struct {
-	root, addr string
-	rebuild    bool
+	root, addr  string
+	rebuild     bool
+	store       string
+	migrate     bool
+	metadata    string
+	layout      string
+	convert     bool
+	compression string
+	dedupe      bool
+
+	uploadLimit int64
 
 	registrationOnce sync.Once
 	parseOnce        sync.Once
@@ -636,8 +1622,16 @@ type args struct {
 func (a *args) register() {
 	a.registrationOnce.Do(func() {
 		flag.StringVar(&a.root, "root", "./", "path to generated file storage")
+		flag.StringVar(&a.store, "store", "filesystem", "paste storage backend (filesystem or sqlite)")
+		flag.BoolVar(&a.migrate, "migrate", false, "with -store=sqlite, import pastes from the filesystem store under -root first")
+		flag.StringVar(&a.metadata, "metadata", "auto", "where the filesystem store keeps paste metadata (auto, xattr or sidecar)")
+		flag.StringVar(&a.layout, "layout", "auto", "how the filesystem store arranges paste files (auto, flat or sharded); auto keeps whatever's already on disk")
+		flag.BoolVar(&a.convert, "convertlayout", false, "move pastes kept in the other layout into -layout at startup")
+		flag.StringVar(&a.compression, "compression", "none", "how new paste bodies are compressed at rest (none, gzip or zstd)")
+		flag.BoolVar(&a.dedupe, "dedupe", false, "with -store=filesystem, keep identical unencrypted paste bodies only once")
 		flag.StringVar(&a.addr, "addr", "0.0.0.0:8080", "bind address and port")
 		flag.BoolVar(&a.rebuild, "rebuild", false, "rebuild all templates for each request")
+		flag.Int64Var(&a.uploadLimit, "uploadlimit", 16<<20, "maximum size, in bytes, of a paste uploaded to /paste/upload")
 	})
 }
 
@@ -661,10 +1655,47 @@ func init() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	RegisterTemplateFunction("encryptionAllowed", func(ri *RenderContext) bool { return Env() == EnvironmentDevelopment || RequestIsHTTPS(ri.Request) })
 	RegisterTemplateFunction("editAllowed", func(ri *RenderContext) bool { return isEditAllowed(ri.Obj.(*Paste), ri.Request) })
+	RegisterTemplateFunction("ownerAllowed", func(ri *RenderContext) bool { return isOwnerAllowed(ri.Obj.(*Paste), ri.Request) })
+	RegisterTemplateFunction("userAllowed", func(ri *RenderContext, permission string) bool { return isUserAllowed(permission, ri.Request) })
 	RegisterTemplateFunction("render", renderPaste)
+	RegisterTemplateFunction("renderRevision", renderRevision)
+	RegisterTemplateFunction("renderFile", renderPasteFile)
+	RegisterTemplateFunction("renderRevisionFile", renderRevisionFile)
+	RegisterTemplateFunction("editorFiles", editorFiles)
+	RegisterTemplateFunction("pasteFileURL", pasteFileURL)
+	RegisterTemplateFunction("pasteAttachmentURL", pasteAttachmentURL)
 	RegisterTemplateFunction("pasteURL", pasteURL)
+	RegisterTemplateFunction("pasteURLForID", pasteURLForID)
+	RegisterTemplateFunction("pasteDiffURL", pasteDiffURL)
+	RegisterTemplateFunction("revisionURL", revisionURL)
+	RegisterTemplateFunction("revisionChangesURL", revisionChangesURL)
+	RegisterTemplateFunction("pasteRevisions", func(p *Paste) []*PasteRevision {
+		revs, err := p.Revisions()
+		if err != nil {
+			glog.Errorf("Failed to list revisions for %s: %s", p.ID, err.Error())
+			return nil
+		}
+		return revs
+	})
+	RegisterTemplateFunction("pasteAttachments", func(p *Paste) []*PasteAttachment {
+		attachments, err := p.Attachments()
+		if err != nil {
+			glog.Errorf("Failed to list attachments for %s: %s", p.ID, err.Error())
+			return nil
+		}
+		return attachments
+	})
+	RegisterTemplateFunction("byteSize", func(n int64) ByteSize {
+		return ByteSize(n)
+	})
+	RegisterTemplateFunction("uploadLimit", func() ByteSize {
+		return ByteSize(arguments.uploadLimit)
+	})
+	RegisterTemplateFunction("maxPasteViews", func() int {
+		return MAX_PASTE_VIEWS
+	})
 	RegisterTemplateFunction("pasteWillExpire", func(p *Paste) bool {
-		return p.Expiration != "" && p.Expiration != "-1"
+		return p.BurnsAfterReading() || p.MaxViews > 0 || !p.ExpirationTime().IsZero()
 	})
 	RegisterTemplateFunction("pasteFromID", func(id PasteID) *Paste {
 		p, err := pasteStore.Get(id, nil)
@@ -702,6 +1733,7 @@ func init() {
 		io.Copy(b, reader)
 		return b.String()
 	})
+	RegisterTemplateFunction("clientCiphertext", clientCiphertext)
 	RegisterTemplateFunction("requestVariable", requestVariable)
 
 	sesdir := filepath.Join(arguments.root, "sessions")
@@ -745,10 +1777,104 @@ func init() {
 
 	pastedir := filepath.Join(arguments.root, "pastes")
 	os.Mkdir(pastedir, 0700)
-	pasteStore = NewFilesystemPasteStore(pastedir)
-	pasteStore.PasteDestroyCallback = PasteCallback(pasteDestroyCallback)
+	metadataMode := FilesystemMetadataMode(arguments.metadata)
+	switch metadataMode {
+	case FilesystemMetadataAuto, FilesystemMetadataXattr, FilesystemMetadataSidecar:
+	default:
+		glog.Fatal("unknown metadata mode ", arguments.metadata)
+	}
+	layout := FilesystemLayout(arguments.layout)
+	switch layout {
+	case "auto":
+		layout = detectLayout(pastedir)
+	case FilesystemLayoutFlat, FilesystemLayoutSharded:
+	default:
+		glog.Fatal("unknown paste layout ", arguments.layout)
+	}
+	fsPasteStore := NewFilesystemPasteStore(pastedir, metadataMode, layout)
+
+	if pasteCompression, err = parsePasteCompression(arguments.compression); err != nil {
+		glog.Fatal(err)
+	}
+
+	switch arguments.store {
+	case "filesystem":
+		// Nothing else is using the store yet, so any write still in
+		// progress was cut short.
+		if n, err := fsPasteStore.RecoverInterruptedWrites(); err != nil {
+			glog.Error("recovering interrupted writes failed: ", err)
+		} else if n > 0 {
+			glog.Info("Finished ", n, " interrupted paste writes.")
+		}
+
+		// Pastes in the other directory layout, or written under the other
+		// metadata layout, stay readable until they're converted. Moving a
+		// whole store is only done when it's asked for.
+		go func() {
+			if arguments.convert {
+				n, err := fsPasteStore.ConvertLayout()
+				if err != nil {
+					glog.Error("paste layout conversion failed: ", err)
+					return
+				}
+				if n > 0 {
+					glog.Info("Moved ", n, " pastes into the ", layout, " layout.")
+				}
+			}
+
+			n, err := fsPasteStore.ConvertMetadata()
+			if err != nil {
+				glog.Error("paste metadata conversion failed: ", err)
+				return
+			}
+			if n > 0 {
+				glog.Info("Converted metadata for ", n, " pastes.")
+			}
+		}()
+
+		fsPasteStore.Deduplicate = arguments.dedupe
+		// Blobs are collected even with deduplication off, as pastes go on
+		// releasing the ones they were kept in.
+		go fsPasteStore.collectBlobsPeriodically(time.Hour)
+
+		fsPasteStore.PasteUpdateCallback = PasteCallback(pasteUpdateCallback)
+		fsPasteStore.PasteDestroyCallback = PasteCallback(pasteDestroyCallback)
+		pasteStore = fsPasteStore
+	case "sqlite":
+		sqlitePasteStore, err := NewSQLitePasteStore(filepath.Join(arguments.root, "pastes.db"))
+		if err != nil {
+			glog.Fatal("failed to open the paste database: ", err)
+		}
+
+		if arguments.migrate {
+			n, err := sqlitePasteStore.ImportFilesystemPasteStore(fsPasteStore)
+			if err != nil {
+				glog.Fatal("paste migration failed: ", err)
+			}
+			glog.Info("Migrated ", n, " pastes from ", pastedir, ".")
+		}
+
+		// Bodies are held in memory on their way into the database. Nothing
+		// bigger than an upload (or a paste) is accepted; twice that leaves
+		// room for compression or encryption to grow it.
+		sqlitePasteStore.BodyLimit = 2 * arguments.uploadLimit
+		if limit := 2 * int64(PASTE_MAXIMUM_LENGTH); sqlitePasteStore.BodyLimit < limit {
+			sqlitePasteStore.BodyLimit = limit
+		}
+		sqlitePasteStore.PasteUpdateCallback = PasteCallback(pasteUpdateCallback)
+		sqlitePasteStore.PasteDestroyCallback = PasteCallback(pasteDestroyCallback)
+		pasteStore = sqlitePasteStore
+	default:
+		glog.Fatal("unknown paste store ", arguments.store)
+	}
 
-	pasteExpirator = gotimeout.NewExpirator(filepath.Join(arguments.root, "expiry.gob"), &ExpiringPasteStore{pasteStore})
+	expiryPath := filepath.Join(arguments.root, "expiry.gob")
+	if n, err := reconcileExpirations(expiryPath, pasteStore); err != nil {
+		glog.Error("paste expiration reconciliation failed: ", err)
+	} else {
+		glog.Info(n, " pastes are due to expire.")
+	}
+	pasteExpirator = gotimeout.NewExpirator(expiryPath, &ExpiringPasteStore{pasteStore})
 	ephStore = gotimeout.NewMap()
 
 	accountPath := filepath.Join(arguments.root, "accounts")
@@ -813,14 +1939,18 @@ func main() {
 		Path("/new").
 		Handler(http.HandlerFunc(pasteCreate))
 
+	pasteRouter.Methods("POST", "PUT").
+		Path("/upload").
+		Handler(http.HandlerFunc(pasteUploadCreate))
+
 	pasteRouter.Methods("GET").
 		Path("/{id}.json").
-		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, ModelRenderFunc(getPasteJSONHandler))).
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, sendsETag(burnsAfterReading(ModelRenderFunc(getPasteJSONHandler))))).
 		Name("show")
 
 	pasteRouter.Methods("GET").
 		Path("/{id}").
-		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, RenderPageForModel("paste_show"))).
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, sendsETag(confirmsBurn(burnsAfterReading(RenderPageForModel("paste_show")))))).
 		Name("show")
 
 	pasteRouter.Methods("POST").
@@ -835,23 +1965,76 @@ func main() {
 		Path("/{id}/disavow").
 		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(ModelRenderFunc(pasteUngrantHandler))))
 
-	pasteRouter.Methods("GET").
+	pasteRouter.Methods("GET", "HEAD").
 		Path("/{id}/raw").
-		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, ModelRenderFunc(getPasteRawHandler))).
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, sendsETag(servesPasteBody(ModelRenderFunc(getPasteRawHandler))))).
 		Name("raw")
-	pasteRouter.Methods("GET").
+	pasteRouter.Methods("GET", "HEAD").
 		Path("/{id}/download").
-		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, ModelRenderFunc(getPasteRawHandler))).
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, sendsETag(servesPasteBody(ModelRenderFunc(getPasteRawHandler))))).
 		Name("download")
 
+	pasteRouter.Methods("GET").
+		Path("/{id}/raw/{file}").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, burnsAfterReading(ModelRenderFunc(getPasteFileRawHandler)))).
+		Name("file_raw")
+	pasteRouter.Methods("GET").
+		Path("/{id}/download/{file}").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, burnsAfterReading(ModelRenderFunc(getPasteFileRawHandler)))).
+		Name("file_download")
+	pasteRouter.Methods("GET").
+		Path("/{id}/attachments/{attachment}").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, burnsAfterReading(ModelRenderFunc(getPasteAttachmentHandler)))).
+		Name("attachment")
+	pasteRouter.Methods("GET").
+		Path("/{id}/attachments/{attachment}/preview").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, burnsAfterReading(ModelRenderFunc(getPasteAttachmentHandler)))).
+		Name("attachment_preview")
+	pasteRouter.Methods("POST").
+		Path("/{id}/attachments").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(pasteAttach))).
+		Name("attach")
+	pasteRouter.Methods("POST").
+		Path("/{id}/attachments/{attachment}/delete").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(pasteAttachmentDelete))).
+		Name("attachment_delete")
+
+	pasteRouter.Methods("GET").
+		Path("/{id}/zip").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, burnsAfterReading(ModelRenderFunc(getPasteZipHandler)))).
+		Name("zip")
+
+	pasteRouter.Methods("GET").
+		Path("/{id}/rev/{rev:[0-9]+}").
+		Handler(RequiredModelObjectHandler(lookupPasteRevisionWithRequest, burnsAfterReading(RenderPageForModel("paste_revision")))).
+		Name("revision")
+	pasteRouter.Methods("GET").
+		Path("/{id}/rev/{rev:[0-9]+}/raw").
+		Handler(RequiredModelObjectHandler(lookupPasteRevisionWithRequest, burnsAfterReading(ModelRenderFunc(getRevisionRawHandler)))).
+		Name("revision_raw")
+
+	pasteRouter.Methods("GET").
+		Path("/{id}/rev/{rev:[0-9]+}/diff/{other:[0-9]+}").
+		Handler(RequiredModelObjectHandler(lookupRevisionDiffWithRequest, burnsAfterReading(RenderPageForModel("paste_diff")))).
+		Name("revision_diff")
+	pasteRouter.Methods("GET").
+		Path("/{id}/diff/{other}").
+		Handler(RequiredModelObjectHandler(lookupPasteDiffWithRequest, burnsAfterReading(RenderPageForModel("paste_diff")))).
+		Name("diff")
+
 	pasteRouter.Methods("GET").
 		Path("/{id}/edit").
-		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(RenderPageForModel("paste_edit")))).
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(sendsETag(RenderPageForModel("paste_edit"))))).
 		Name("edit")
 	pasteRouter.Methods("POST").
 		Path("/{id}/edit").
 		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(pasteUpdate)))
 
+	pasteRouter.Methods("POST", "PUT").
+		Path("/{id}/upload").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(pasteUpload))).
+		Name("upload")
+
 	pasteRouter.Methods("GET").
 		Path("/{id}/delete").
 		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(RenderPageForModel("paste_delete_confirm")))).
@@ -860,6 +2043,21 @@ func main() {
 		Path("/{id}/delete").
 		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresEditPermission(pasteDelete)))
 
+	pasteRouter.Methods("POST").
+		Path("/{id}/password").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresOwnerPermission("change the password of", pastePasswordChange))).
+		Name("password")
+
+	pasteRouter.Methods("POST").
+		Path("/{id}/expiration").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, requiresOwnerPermission("change the expiration of", pasteExpirationChange))).
+		Name("expiration")
+
+	pasteRouter.Methods("POST").
+		Path("/{id}/fork").
+		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, ModelRenderFunc(pasteFork))).
+		Name("fork")
+
 	pasteRouter.Methods("POST").
 		Path("/{id}/report").
 		Handler(RequiredModelObjectHandler(lookupPasteWithRequest, reportPaste)).
@@ -880,12 +2078,71 @@ func main() {
 		Path("/{id}/authenticate").
 		Handler(RenderPageHandler("paste_authenticate_disallowed"))
 
+	apiRouter = router.PathPrefix("/api/v1").Subrouter()
+
+	apiRouter.Methods("GET").
+		Path("/pastes").
+		Handler(http.HandlerFunc(apiPastesHandler)).
+		Name("api_pastes")
+	apiRouter.Methods("POST").
+		Path("/pastes").
+		Handler(http.HandlerFunc(apiPasteCreate))
+
+	apiRouter.Methods("GET").
+		Path("/pastes/{id}").
+		Handler(apiPasteHandler(apiPasteShow)).
+		Name("api_paste")
+	apiRouter.Methods("PUT", "PATCH").
+		Path("/pastes/{id}").
+		Handler(apiPasteHandler(apiRequiresEditPermission(apiPasteUpdate)))
+	apiRouter.Methods("DELETE").
+		Path("/pastes/{id}").
+		Handler(apiPasteHandler(apiRequiresEditPermission(apiPasteDelete)))
+
+	apiRouter.Methods("GET").
+		Path("/pastes/{id}/revisions").
+		Handler(apiPasteHandler(apiPasteRevisions))
+	apiRouter.Methods("POST").
+		Path("/pastes/{id}/fork").
+		Handler(apiPasteHandler(apiPasteFork))
+
+	apiRouter.Methods("POST").
+		Path("/pastes/{id}/authenticate").
+		Handler(http.HandlerFunc(apiPasteAuthenticate)).
+		Name("api_authenticate")
+	apiRouter.Methods("PUT").
+		Path("/pastes/{id}/password").
+		Handler(apiPasteHandler(apiRequiresOwnerPermission("change the password of", apiPastePasswordChange))).
+		Name("api_password")
+	apiRouter.Methods("POST").
+		Path("/pastes/{id}/expiration").
+		Handler(apiPasteHandler(apiRequiresOwnerPermission("change the expiration of", apiPasteExpirationChange)))
+
+	apiRouter.Methods("POST").
+		Path("/pastes/{id}/grants").
+		Handler(apiPasteHandler(apiRequiresEditPermission(apiPasteGrant)))
+	apiRouter.Methods("POST").
+		Path("/grants/{grantkey}/accept").
+		Handler(http.HandlerFunc(apiGrantAccept)).
+		Name("api_grant_accept")
+	apiRouter.Methods("POST").
+		Path("/pastes/{id}/disavow").
+		Handler(apiPasteHandler(apiRequiresEditPermission(apiPasteDisavow)))
+
+	apiRouter.Methods("POST").
+		Path("/pastes/{id}/reports").
+		Handler(apiPasteHandler(apiPasteReport))
+
+	apiRouter.PathPrefix("/").Handler(http.HandlerFunc(apiNotFoundHandler))
+
 	router.Path("/admin").Handler(requiresUserPermission("admin", RenderPageHandler("admin_home")))
 
 	router.Path("/admin/reports").Handler(requiresUserPermission("admin", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		RenderPage(w, r, "admin_reports", reportStore.Reports)
 	})))
 
+	router.Methods("GET").Path("/admin/pastes").Handler(requiresUserPermission("admin", http.HandlerFunc(adminPastesHandler)))
+	router.Methods("POST").Path("/admin/pastes").Handler(requiresUserPermission("admin", http.HandlerFunc(adminPastesBulkHandler)))
 	router.Methods("POST").Path("/admin/promote").Handler(requiresUserPermission("admin", http.HandlerFunc(adminPromoteHandler)))
 
 	router.Methods("POST").
@@ -901,8 +2158,12 @@ func main() {
 	pasteRouter.Methods("GET").Path("/").Handler(RedirectHandler("/"))
 
 	router.Path("/paste").Handler(RedirectHandler("/"))
+	router.Path("/public").Handler(http.HandlerFunc(publicPastesHandler))
+	router.Path("/public/feed").Handler(http.HandlerFunc(publicPastesFeedHandler))
 	router.Path("/session").Handler(http.HandlerFunc(sessionHandler))
 	router.Path("/session/raw").Handler(http.HandlerFunc(sessionHandler))
+	router.Path("/session/search").Handler(http.HandlerFunc(sessionHandler))
+	router.Path("/session/search/raw").Handler(http.HandlerFunc(sessionHandler))
 	router.Path("/about").Handler(RenderPageHandler("about"))
 	router.Methods("GET", "HEAD").Path("/languages.json").Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -3,15 +3,17 @@ package main
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"github.com/DHowett/go-xattr"
+	"crypto/sha256"
 	"golang.org/x/crypto/scrypt"
 	"io"
+	"io/ioutil"
 	"os"
-	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 )
 
-const CURRENT_ENCRYPTION_METHOD string = "2"
+const CURRENT_ENCRYPTION_METHOD string = "3"
 
 type PasteStore interface {
 	GenerateNewPasteID(bool) (PasteID, error)
@@ -20,9 +22,22 @@ type PasteStore interface {
 	Save(*Paste) error
 	Destroy(*Paste) error
 
+	Revisions(*Paste) ([]*PasteRevision, error)
+	Attachments(*Paste) ([]*PasteAttachment, error)
+
 	EncryptionKeyForPasteWithPassword(*Paste, string) []byte
+	openBody(*Paste) (readSeekCloser, error)
 	readStream(*Paste) (*PasteReader, error)
 	writeStream(*Paste) (*PasteWriter, error)
+	readRevisionStream(*PasteRevision) (*PasteReader, error)
+	readAttachmentStream(*PasteAttachment) (*PasteReader, error)
+	writeAttachmentStream(*PasteAttachment) (pasteBodyWriter, error)
+	destroyAttachment(*PasteAttachment) error
+	reencrypt(p *Paste, key, salt []byte) error
+	countView(*Paste, int) (int, error)
+	storeExpiration(*Paste) error
+	pasteIDs() ([]PasteID, error)
+	bodyLength(*Paste) (int64, error)
 }
 
 type PasteID string
@@ -55,6 +70,16 @@ func (e PasteNotFoundError) Error() string {
 	return "Paste " + e.ID.String() + " was not found."
 }
 
+// PasteModifiedError is returned by a PasteWriter whose paste has been given
+// a new body by somebody else since it was loaded.
+type PasteModifiedError struct {
+	ID PasteID
+}
+
+func (e PasteModifiedError) Error() string {
+	return "Paste " + e.ID.String() + " was changed by somebody else while you were editing it."
+}
+
 type PasteReader struct {
 	io.ReadCloser
 	paste *Paste
@@ -64,30 +89,75 @@ func (pr *PasteReader) Close() error {
 	return pr.ReadCloser.Close()
 }
 
+// pasteBodyWriter is where a store's PasteWriter puts the (possibly
+// encrypted) body. Nothing written to it takes effect until it's closed, when
+// the body is committed along with the paste's metadata in one go, and none of
+// it does if it's aborted instead.
+type pasteBodyWriter interface {
+	io.WriteCloser
+	Abort() error
+}
+
 type PasteWriter struct {
 	io.WriteCloser
 	paste *Paste
+	body  pasteBodyWriter
+}
+
+func newPasteWriter(p *Paste, body pasteBodyWriter) *PasteWriter {
+	return &PasteWriter{WriteCloser: compressedPasteWriter(p, encryptedPasteWriter(p, body)), paste: p, body: body}
 }
 
+// Close puts the new body in place and saves the paste along with it,
+// returning whatever kept either from happening.
 func (pr *PasteWriter) Close() error {
-	pr.paste.Save()
 	return pr.WriteCloser.Close()
 }
 
+// Abort throws away everything written so far, leaving the paste as it was
+// (or leaving no trace of it at all, if it's new.)
+func (pr *PasteWriter) Abort() error {
+	return pr.body.Abort()
+}
+
 type Paste struct {
 	ID         PasteID
 	Language   *Language
 	Encrypted  bool
 	Expiration string
 	Title      string
+	// Parent is the paste this one was forked from, if any.
+	Parent PasteID
+	// Files splits the body of a multi-file paste into its files.
+	Files []*PasteFile
+	// ClientEncryption is the method the client used to encrypt the paste's
+	// body before uploading it, if it did.
+	ClientEncryption string
+	// MaxViews is the number of times the paste can be viewed before it's
+	// destroyed, or 0 if it can be viewed any number of times.
+	MaxViews int
+	// Views is the number of times the paste had been viewed when it was loaded.
+	Views int
+	// Owner names the account that created the paste, if it was signed in.
+	Owner string
+	// Visibility decides who can find (and read) the paste.
+	Visibility PasteVisibility
 
 	store   PasteStore
 	mtime   time.Time
 	exptime time.Time
+	created time.Time
 
 	encryptionKey    []byte
 	encryptionSalt   []byte
 	encryptionMethod string
+
+	// compression is the codec the body was written with, if any.
+	compression string
+	// blob is the SHA-256 of the deduplicated body, if the store keeps it apart.
+	blob string
+	// version names the body last written; it's what p's ETag is made of.
+	version string
 }
 
 func (p *Paste) Save() error {
@@ -110,10 +180,64 @@ func (p *Paste) LastModified() time.Time {
 	return p.mtime
 }
 
+// ETag names the version of p's body (and the title, language and files that
+// go along with it), changing every time a new one is written.
+func (p *Paste) ETag() string {
+	return pasteETag(p.version, p.mtime)
+}
+
+// pasteETag is the ETag of the body written as version or, for one written
+// before versions were recorded, last modified at mtime. A revision shares
+// its ETag with the paste as it was when the revision was taken.
+func pasteETag(version string, mtime time.Time) string {
+	if version == "" {
+		return `"` + strconv.FormatInt(mtime.UnixNano(), 36) + `"`
+	}
+	return `"` + version + `"`
+}
+
+// newVersion names the body that's about to be written in place of p's
+// current one. Unlike its modification time, it's different every time.
+func (p *Paste) newVersion() error {
+	version, err := generateRandomBase32String(10, -1)
+	if err != nil {
+		return err
+	}
+	p.version = version
+	return nil
+}
+
+// writtenPaste returns a copy of p that describes the body a PasteWriter has
+// just written for it, for the store to save along with that body. p itself
+// is brought up to date only once the body has been committed, so that it
+// goes on describing the body that's in place if committing fails.
+func (p *Paste) writtenPaste() *Paste {
+	written := *p
+	if written.Encrypted {
+		written.encryptionMethod = CURRENT_ENCRYPTION_METHOD
+	}
+	return &written
+}
+
 func (p *Paste) ExpirationTime() time.Time {
 	return p.exptime
 }
 
+// CreationTime is when p was created or, for a paste made before that was
+// recorded, when it was last modified.
+func (p *Paste) CreationTime() time.Time {
+	if p.created.IsZero() {
+		return p.mtime
+	}
+	return p.created
+}
+
+// Length is the size of p's body as stored, which for an encrypted paste
+// includes the encryption's overhead.
+func (p *Paste) Length() (int64, error) {
+	return p.store.bodyLength(p)
+}
+
 func (p *Paste) SetEncryptionKey(key []byte) {
 	p.encryptionKey = key
 	p.Encrypted = (key != nil)
@@ -123,18 +247,264 @@ func (p *Paste) EncryptionKeyWithPassword(password string) []byte {
 	return p.store.EncryptionKeyForPasteWithPassword(p, password)
 }
 
+// metadataGetter returns the value of the named piece of metadata, or dflt if it's missing.
+type metadataGetter func(name string, dflt string) string
+
+// metadataPutter persists the named piece of metadata.
+type metadataPutter func(name string, value string) error
+
+// pasteMetadataNames lists every piece of metadata a store may have to carry
+// for a paste, one of its revisions or one of its attachments.
+var pasteMetadataNames = []string{
+	"language",
+	"expiration",
+	"title",
+	"hmac",
+	"encryption_version",
+	"encryption_salt",
+	"parent",
+	"files",
+	"client_encryption",
+	"expires_at",
+	"max_views",
+	"views",
+	"name",
+	"content_type",
+	"length",
+	"owner",
+	"visibility",
+	"created_at",
+	"compression",
+	"blob",
+	"version",
+}
+
+// loadMetadata populates p from a store's metadata. If p is encrypted and key
+// is nil, p is still populated and PasteEncryptedError is returned.
+func (p *Paste) loadMetadata(get metadataGetter, key []byte) (err error) {
+	hmac := get("hmac", "")
+	p.encryptionMethod = get("encryption_version", "")
+	if hmac != "" {
+		if p.encryptionMethod == "" {
+			p.encryptionMethod = "1"
+		}
+
+		p.Encrypted = true
+		salt := get("encryption_salt", "")
+		if salt == "" {
+			p.encryptionSalt = []byte(p.ID.String())
+		} else {
+			saltb, e := base32Encoder.DecodeString(salt)
+			if e != nil {
+				return e
+			}
+
+			p.encryptionSalt = saltb
+		}
+
+		err = PasteEncryptedError{ID: p.ID}
+		if key != nil {
+			hmacBytes, e := base32Encoder.DecodeString(hmac)
+			if e != nil {
+				return e
+			}
+
+			MACMessage := encryptionMethodHandlers[p.encryptionMethod].generateMACMessage(p)
+			ok := checkMAC(MACMessage, hmacBytes, key)
+
+			if !ok {
+				return PasteInvalidKeyError{ID: p.ID}
+			}
+
+			p.encryptionKey = key
+			err = nil
+		}
+	}
+
+	p.Language = LanguageNamed(get("language", "text"))
+	p.Expiration = get("expiration", "")
+	p.Title = get("title", "")
+	p.Parent = PasteIDFromString(get("parent", ""))
+	p.ClientEncryption = get("client_encryption", "")
+	p.MaxViews, _ = strconv.Atoi(get("max_views", "0"))
+	p.Views, _ = strconv.Atoi(get("views", "0"))
+	p.Owner = get("owner", "")
+	p.compression = get("compression", "")
+	p.blob = get("blob", "")
+	p.version = get("version", "")
+	p.Visibility = PasteVisibility(get("visibility", string(PasteVisibilityUnlisted)))
+
+	// A paste whose file list can't be read is shown as a single file.
+	p.Files, _ = decodePasteFiles(get("files", ""))
+
+	// A paste saved before expiration times were recorded doesn't have one
+	// until reconcileExpirations works it out.
+	if expiresAt := get("expires_at", ""); expiresAt != "" {
+		p.exptime, _ = time.Parse(time.RFC3339, expiresAt)
+	}
+
+	if createdAt := get("created_at", ""); createdAt != "" {
+		p.created, _ = time.Parse(time.RFC3339, createdAt)
+	}
+
+	return
+}
+
+// storeMetadata hands every piece of p's metadata to put, stopping at the first error.
+func (p *Paste) storeMetadata(put metadataPutter) error {
+	if err := put("language", p.Language.ID); err != nil {
+		return err
+	}
+
+	if err := p.storeExpirationMetadata(put); err != nil {
+		return err
+	}
+
+	if err := put("title", p.Title); err != nil {
+		return err
+	}
+
+	if err := put("files", encodePasteFiles(p.Files)); err != nil {
+		return err
+	}
+
+	// Always written, so that an owner who disavows a paste is forgotten.
+	if err := put("owner", p.Owner); err != nil {
+		return err
+	}
+
+	if err := put("visibility", string(p.Visibility)); err != nil {
+		return err
+	}
+
+	if !p.created.IsZero() {
+		if err := put("created_at", p.created.UTC().Format(time.RFC3339)); err != nil {
+			return err
+		}
+	}
+
+	if p.Parent != "" {
+		if err := put("parent", p.Parent.String()); err != nil {
+			return err
+		}
+	}
+
+	if p.ClientEncryption != "" {
+		if err := put("client_encryption", p.ClientEncryption); err != nil {
+			return err
+		}
+	}
+
+	// N.B. views is only ever written by countView, so that saving a paste
+	// can't undo views counted since it was loaded. Likewise, how the body is
+	// stored (and encrypted) is only written along with the body, by
+	// storeBodyMetadata.
+	if p.MaxViews > 0 {
+		if err := put("max_views", strconv.Itoa(p.MaxViews)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// storeExpirationMetadata hands the metadata recording when p expires to put.
+// Both pieces are always written, blank if need be, so that nothing is left
+// over from an expiration that's since been cancelled.
+func (p *Paste) storeExpirationMetadata(put metadataPutter) error {
+	if err := put("expiration", p.Expiration); err != nil {
+		return err
+	}
+
+	expiresAt := ""
+	if !p.exptime.IsZero() {
+		expiresAt = p.exptime.UTC().Format(time.RFC3339)
+	}
+	return put("expires_at", expiresAt)
+}
+
+// storeBodyMetadata hands the metadata describing how p's body is stored to
+// put. It's written only when the body is, so that saving a paste loaded
+// before its body was replaced can't leave the new body misdescribed.
+func (p *Paste) storeBodyMetadata(put metadataPutter) error {
+	if p.Encrypted {
+		MACMessage := encryptionMethodHandlers[p.encryptionMethod].generateMACMessage(p)
+		hmacBytes := constructMAC([]byte(MACMessage), p.encryptionKey)
+		hmac := base32Encoder.EncodeToString(hmacBytes)
+		if err := put("hmac", hmac); err != nil {
+			return err
+		}
+
+		if err := put("encryption_version", p.encryptionMethod); err != nil {
+			return err
+		}
+
+		if err := put("encryption_salt", base32Encoder.EncodeToString(p.encryptionSalt)); err != nil {
+			return err
+		}
+	} else {
+		// Blank out whatever is left over from when the paste had a password.
+		for _, name := range []string{"hmac", "encryption_version", "encryption_salt"} {
+			if err := put(name, ""); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := put("compression", p.compression); err != nil {
+		return err
+	}
+	if err := put("version", p.version); err != nil {
+		return err
+	}
+	return put("blob", p.blob)
+}
+
+func deriveEncryptionKey(p *Paste, password string) []byte {
+	return deriveEncryptionKeyWithSalt(p.encryptionSalt, password)
+}
+
+func deriveEncryptionKeyWithSalt(salt []byte, password string) []byte {
+	if password == "" {
+		return nil
+	}
+
+	key, err := scrypt.Key([]byte(password), salt, 16384, 8, 1, 32)
+	if err != nil {
+		panic(err)
+	}
+
+	return key
+}
+
 type PasteCallback func(*Paste)
 type FilesystemPasteStore struct {
 	PasteUpdateCallback  PasteCallback
 	PasteDestroyCallback PasteCallback
-	path                 string
+	// Deduplicate keeps the bodies of unencrypted pastes in shared blobs.
+	Deduplicate bool
+	path        string
+	layout      FilesystemLayout
+
+	// metadata is where metadata is written; legacyMetadata is consulted for
+	// pastes that haven't yet been converted to it.
+	metadata       metadataBackend
+	legacyMetadata metadataBackend
+
+	// metadataLock serializes counting views, which reads, increments and
+	// rewrites a paste's metadata, against anything else that rewrites it.
+	metadataLock sync.Mutex
 }
 
 func noopPasteCallback(p *Paste) {}
 
-func NewFilesystemPasteStore(path string) *FilesystemPasteStore {
+func NewFilesystemPasteStore(path string, mode FilesystemMetadataMode, layout FilesystemLayout) *FilesystemPasteStore {
+	metadata, legacyMetadata := newMetadataBackends(path, mode)
 	return &FilesystemPasteStore{
 		path:                 path,
+		layout:               layout,
+		metadata:             metadata,
+		legacyMetadata:       legacyMetadata,
 		PasteUpdateCallback:  PasteCallback(noopPasteCallback),
 		PasteDestroyCallback: PasteCallback(noopPasteCallback),
 	}
@@ -155,7 +525,7 @@ func (store *FilesystemPasteStore) GenerateNewPasteID(encrypted bool) (PasteID,
 }
 
 func (store *FilesystemPasteStore) filenameForID(id PasteID) string {
-	return filepath.Join(store.path, id.String())
+	return store.locate(id, "")
 }
 
 func (store *FilesystemPasteStore) New(encrypted bool) (p *Paste, err error) {
@@ -164,27 +534,27 @@ func (store *FilesystemPasteStore) New(encrypted bool) (p *Paste, err error) {
 		panic(err)
 	}
 
-	p = &Paste{ID: id, store: store}
+	p = &Paste{ID: id, store: store, created: time.Now().UTC().Truncate(time.Second)}
 
 	if encrypted {
 		p.encryptionSalt, _ = generateRandomBytes(16)
-		p.encryptionMethod = CURRENT_ENCRYPTION_METHOD
 	}
 
 	return
 }
 
-func putMetadata(fn string, name string, value string) error {
-	return xattr.Setxattr(fn, "user.paste."+name, []byte(value), 0, 0)
-}
-
-func getMetadata(fn string, name string, dflt string) string {
-	bytes, err := xattr.Getxattr(fn, "user.paste."+name, 0, 0)
+func (store *FilesystemPasteStore) loadMetadata(filename string) (map[string]string, error) {
+	md, err := store.metadata.Load(filename)
 	if err != nil {
-		return dflt
+		return nil, err
 	}
 
-	return string(bytes)
+	if len(md) == 0 {
+		if legacy, err := store.legacyMetadata.Load(filename); err == nil {
+			md = legacy
+		}
+	}
+	return md, nil
 }
 
 func (store *FilesystemPasteStore) Get(id PasteID, key []byte) (p *Paste, err error) {
@@ -195,133 +565,93 @@ func (store *FilesystemPasteStore) Get(id PasteID, key []byte) (p *Paste, err er
 		return
 	}
 
-	paste := &Paste{ID: id, store: store, mtime: stat.ModTime()}
-
-	hmac := getMetadata(filename, "hmac", "")
-	paste.encryptionMethod = getMetadata(filename, "encryption_version", "")
-	if hmac != "" {
-		if paste.encryptionMethod == "" {
-			paste.encryptionMethod = "1"
-		}
-
-		paste.Encrypted = true
-		salt := getMetadata(filename, "encryption_salt", "")
-		if salt == "" {
-			paste.encryptionSalt = []byte(paste.ID.String())
-		} else {
-			saltb, e := base32Encoder.DecodeString(salt)
-			if e != nil {
-				err = e
-				return
-			}
-
-			paste.encryptionSalt = saltb
-		}
-
-		err = PasteEncryptedError{ID: id}
-		if key != nil {
-			err = nil
-
-			hmacBytes, e := base32Encoder.DecodeString(hmac)
-			if e != nil {
-				err = e
-				return
-			}
-
-			MACMessage := encryptionMethodHandlers[paste.encryptionMethod].generateMACMessage(paste)
-			ok := checkMAC(MACMessage, hmacBytes, key)
-
-			if !ok {
-				err = PasteInvalidKeyError{ID: id}
-				return
-			}
-
-			paste.encryptionKey = key
-			err = nil
-		}
+	md, err := store.loadMetadata(filename)
+	if err != nil {
+		return
 	}
 
-	paste.Language = LanguageNamed(getMetadata(filename, "language", "text"))
-	paste.Expiration = getMetadata(filename, "expiration", "")
-	paste.Title = getMetadata(filename, "title", "")
-
-	if paste.Expiration != "" {
-		if dur, err := ParseDuration(paste.Expiration); err == nil {
-			paste.exptime = paste.mtime.Add(dur)
+	paste := &Paste{ID: id, store: store, mtime: stat.ModTime()}
+	err = paste.loadMetadata(func(name string, dflt string) string {
+		if v, ok := md[name]; ok {
+			return v
 		}
+		return dflt
+	}, key)
+	if _, ok := err.(PasteEncryptedError); err != nil && !ok {
+		return
 	}
 
-	store.PasteUpdateCallback(paste)
-
 	p = paste
 	return
 }
 
 func (store *FilesystemPasteStore) Save(p *Paste) error {
+	store.metadataLock.Lock()
+	defer store.metadataLock.Unlock()
+
+	// Merged into what's there, as how the body's stored, and its views, are
+	// written elsewhere; a paste still in the legacy layout would lose them.
 	filename := store.filenameForID(p.ID)
-	if err := putMetadata(filename, "language", p.Language.ID); err != nil {
+	md, err := store.loadMetadata(filename)
+	if err != nil {
 		return err
 	}
+	p.storeMetadata(func(name string, value string) error {
+		md[name] = value
+		return nil
+	})
 
-	if p.Expiration != "" {
-		if err := putMetadata(filename, "expiration", p.Expiration); err != nil {
-			return err
-		}
-	}
-
-	if err := putMetadata(filename, "title", p.Title); err != nil {
+	if err := store.metadata.Store(filename, md); err != nil {
 		return err
 	}
 
-	if p.Encrypted {
-		MACMessage := encryptionMethodHandlers[p.encryptionMethod].generateMACMessage(p)
-		hmacBytes := constructMAC([]byte(MACMessage), p.encryptionKey)
-		hmac := base32Encoder.EncodeToString(hmacBytes)
-		if err := putMetadata(filename, "hmac", hmac); err != nil {
-			return err
-		}
-
-		if err := putMetadata(filename, "encryption_version", p.encryptionMethod); err != nil {
-			return err
-		}
-
-		if err := putMetadata(filename, "encryption_salt", base32Encoder.EncodeToString(p.encryptionSalt)); err != nil {
-			return err
-		}
-	}
-
 	store.PasteUpdateCallback(p)
 	return nil
 }
 
 func (store *FilesystemPasteStore) Destroy(p *Paste) error {
-	err := os.Remove(store.filenameForID(p.ID))
+	filename := store.filenameForID(p.ID)
+	refs := store.blobReferences(p.ID)
+	err := os.Remove(filename)
 	if err != nil {
 		return err
 	}
 
+	// Extended attributes leave with the file; a sidecar has to be cleaned up.
+	sidecarMetadataBackend{}.Remove(filename)
+	os.RemoveAll(store.revisionDirectoryForID(p.ID))
+	os.RemoveAll(store.attachmentDirectoryForID(p.ID))
+	store.releaseBlobReferences(refs)
+
 	store.PasteDestroyCallback(p)
 	return nil
 }
 
 func (store *FilesystemPasteStore) EncryptionKeyForPasteWithPassword(p *Paste, password string) []byte {
-	if password == "" {
-		return nil
-	}
+	return deriveEncryptionKey(p, password)
+}
 
-	key, err := scrypt.Key([]byte(password), []byte(p.encryptionSalt), 16384, 8, 1, 32)
+func (store *FilesystemPasteStore) bodyLength(p *Paste) (int64, error) {
+	fi, err := os.Stat(store.bodyFilename(store.filenameForID(p.ID), p.blob))
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
+	return fi.Size(), nil
+}
 
-	return key
+// openBody opens p's body as it's stored, before it's decrypted or decompressed.
+func (store *FilesystemPasteStore) openBody(p *Paste) (readSeekCloser, error) {
+	f, err := os.Open(store.bodyFilename(store.filenameForID(p.ID), p.blob))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
 }
 
 func (store *FilesystemPasteStore) readStream(p *Paste) (*PasteReader, error) {
-	filename := store.filenameForID(p.ID)
 	var r io.ReadCloser
 	var err error
-	if r, err = os.Open(filename); err != nil {
+	if r, err = store.openBody(p); err != nil {
 		return nil, err
 	}
 
@@ -329,23 +659,42 @@ func (store *FilesystemPasteStore) readStream(p *Paste) (*PasteReader, error) {
 		r = encryptionMethodHandlers[p.encryptionMethod].encryptedReadWrapper(p, r)
 	}
 
+	if r, err = decompressedPasteReader(p.compression, r); err != nil {
+		return nil, err
+	}
+
 	return &PasteReader{ReadCloser: r, paste: p}, nil
 }
 
 func (store *FilesystemPasteStore) writeStream(p *Paste) (*PasteWriter, error) {
-	filename := store.filenameForID(p.ID)
-	var w io.WriteCloser
-	var err error
-	if w, err = os.Create(filename); err != nil {
+	if err := store.addLegacyRevision(p); err != nil {
 		return nil, err
 	}
 
-	// N.B. We always write using the newest encryption method.
-	if p.Encrypted {
-		w = encryptionMethodHandlers[p.encryptionMethod].encryptedWriteWrapper(p, w)
+	// The new body is moved over the old one once it's complete, so that it
+	// can be abandoned part of the way through.
+	file, err := ioutil.TempFile(store.path, p.ID.String()+".")
+	if err != nil {
+		return nil, err
+	}
+
+	w := &filesystemPasteBodyWriter{File: file, store: store, paste: p}
+	if store.Deduplicate && !p.Encrypted {
+		w.hash = sha256.New()
+	}
+	return newPasteWriter(p, w), nil
+}
+
+// encryptedPasteWriter wraps w to encrypt p's body, if p is encrypted.
+// N.B. We always write using the newest encryption method; saving a paste
+// written with an older one upgrades it. p is only switched over to it once
+// the new body has been committed (see writtenPaste).
+func encryptedPasteWriter(p *Paste, w io.WriteCloser) io.WriteCloser {
+	if !p.Encrypted {
+		return w
 	}
 
-	return &PasteWriter{WriteCloser: w, paste: p}, nil
+	return encryptionMethodHandlers[CURRENT_ENCRYPTION_METHOD].encryptedWriteWrapper(p, w)
 }
 
 type EncryptionMethodHandlers struct {
@@ -398,4 +747,11 @@ var encryptionMethodHandlers = map[string]EncryptionMethodHandlers{
 			return &WriteCloser{Writer: streamWriter, Closer: w}
 		},
 	},
+	"3": EncryptionMethodHandlers{
+		generateMACMessage: func(p *Paste) []byte {
+			return append([]byte("3|"+p.ID.String()), p.encryptionSalt...)
+		},
+		encryptedReadWrapper:  newGCMChunkReader,
+		encryptedWriteWrapper: newGCMChunkWriter,
+	},
 }
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The admin paste browser pages through every paste in the store. There's no
+// index of pastes to ask, so each page looks at all of them; that's fine for
+// something only admins use, and only now and then.
+
+// adminPastesPerPage is how many pastes the browser shows at a time.
+const adminPastesPerPage = 50
+
+const adminDateFormat = "2006-01-02"
+
+// AdminPasteFilter picks pastes out of the store for the browser.
+type AdminPasteFilter struct {
+	Language      string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// MinSize and MaxSize bound the stored size of a paste's body, in KB.
+	MinSize, MaxSize int64
+	// Encryption is "none", "password", "browser" or "any".
+	Encryption string
+	// Expiration is "never", "expires", "burn" or "views".
+	Expiration string
+	MinReports int
+}
+
+type AdminPasteFilterError string
+
+func (e AdminPasteFilterError) Error() string {
+	return string(e)
+}
+
+func (e AdminPasteFilterError) StatusCode() int {
+	return http.StatusBadRequest
+}
+
+func ParseAdminPasteFilter(values url.Values) (*AdminPasteFilter, error) {
+	f := &AdminPasteFilter{
+		Language:   values.Get("lang"),
+		Encryption: values.Get("encryption"),
+		Expiration: values.Get("expiration"),
+	}
+
+	var err error
+	date := func(name string) time.Time {
+		var t time.Time
+		if v := values.Get(name); v != "" && err == nil {
+			if t, err = time.Parse(adminDateFormat, v); err != nil {
+				err = AdminPasteFilterError("Dates look like 2006-01-02.")
+			}
+		}
+		return t
+	}
+	number := func(name string) int64 {
+		var n int64
+		if v := values.Get(name); v != "" && err == nil {
+			if n, err = strconv.ParseInt(v, 10, 64); err != nil || n < 0 {
+				err = AdminPasteFilterError(fmt.Sprintf("%s has to be a number.", name))
+			}
+		}
+		return n
+	}
+
+	f.CreatedAfter = date("created_after")
+	f.CreatedBefore = date("created_before")
+	if !f.CreatedBefore.IsZero() {
+		// The whole of the day is included.
+		f.CreatedBefore = f.CreatedBefore.Add(24 * time.Hour)
+	}
+	f.MinSize = number("min_size")
+	f.MaxSize = number("max_size")
+	f.MinReports = int(number("min_reports"))
+	if err != nil {
+		return nil, err
+	}
+
+	switch f.Encryption {
+	case "", "none", "password", "browser", "any":
+	default:
+		return nil, AdminPasteFilterError("Unknown encryption filter " + f.Encryption + ".")
+	}
+	switch f.Expiration {
+	case "", "never", "expires", "burn", "views":
+	default:
+		return nil, AdminPasteFilterError("Unknown expiration filter " + f.Expiration + ".")
+	}
+	return f, nil
+}
+
+// AdminPaste is a paste as the browser shows it.
+type AdminPaste struct {
+	*Paste
+	Size    int64
+	Reports ReportInfo
+}
+
+func (a *AdminPaste) ReportCount() int {
+	n := 0
+	for _, count := range a.Reports {
+		n += count
+	}
+	return n
+}
+
+func (f *AdminPasteFilter) matches(a *AdminPaste) bool {
+	p := a.Paste
+	if f.Language != "" && (p.Language == nil || p.Language.ID != f.Language) {
+		return false
+	}
+
+	created := p.CreationTime()
+	if !f.CreatedAfter.IsZero() && created.Before(f.CreatedAfter) {
+		return false
+	}
+	if !f.CreatedBefore.IsZero() && !created.Before(f.CreatedBefore) {
+		return false
+	}
+
+	if f.MinSize > 0 && a.Size < f.MinSize*int64(KB) {
+		return false
+	}
+	if f.MaxSize > 0 && a.Size > f.MaxSize*int64(KB) {
+		return false
+	}
+
+	switch f.Encryption {
+	case "none":
+		if p.Encrypted || p.ClientEncryption != "" {
+			return false
+		}
+	case "password":
+		if !p.Encrypted {
+			return false
+		}
+	case "browser":
+		if p.ClientEncryption == "" {
+			return false
+		}
+	case "any":
+		if !p.Encrypted && p.ClientEncryption == "" {
+			return false
+		}
+	}
+
+	switch f.Expiration {
+	case "never":
+		if !p.ExpirationTime().IsZero() || p.BurnsAfterReading() || p.MaxViews > 0 {
+			return false
+		}
+	case "expires":
+		if p.ExpirationTime().IsZero() {
+			return false
+		}
+	case "burn":
+		if !p.BurnsAfterReading() {
+			return false
+		}
+	case "views":
+		if p.MaxViews == 0 {
+			return false
+		}
+	}
+
+	return a.ReportCount() >= f.MinReports
+}
+
+// adminPastes returns every paste that matches f, newest first.
+func adminPastes(f *AdminPasteFilter) ([]*AdminPaste, error) {
+	ids, err := pasteStore.pasteIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []*AdminPaste
+	for _, id := range ids {
+		// Encrypted pastes come back (along with an error) even without their key.
+		p, _ := pasteStore.Get(id, nil)
+		if p == nil {
+			continue
+		}
+
+		size, err := p.Length()
+		if err != nil {
+			glog.Errorf("Failed to size paste %v: %v", id, err)
+		}
+
+		a := &AdminPaste{Paste: p, Size: size, Reports: reportStore.Reports[id]}
+		if f.matches(a) {
+			found = append(found, a)
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].CreationTime().After(found[j].CreationTime())
+	})
+	return found, nil
+}
+
+// AdminPastePage is one page of the browser.
+type AdminPastePage struct {
+	Pastes []*AdminPaste
+	Total  int
+	Page   int
+	Pages  int
+	// Query is the filter the page was found with, for links to other pages.
+	Query url.Values
+}
+
+// PageQuery is the query string for this page of the same filter.
+func (p *AdminPastePage) PageQuery() string {
+	return p.pageQuery(p.Page)
+}
+
+func (p *AdminPastePage) pageQuery(n int) string {
+	q := url.Values{}
+	for k, v := range p.Query {
+		q[k] = v
+	}
+	if n > 1 {
+		q.Set("page", strconv.Itoa(n))
+	}
+	return q.Encode()
+}
+
+func (p *AdminPastePage) PreviousPageURL() string {
+	if p.Page <= 1 {
+		return ""
+	}
+	return "/admin/pastes?" + p.pageQuery(p.Page-1)
+}
+
+func (p *AdminPastePage) NextPageURL() string {
+	if p.Page >= p.Pages {
+		return ""
+	}
+	return "/admin/pastes?" + p.pageQuery(p.Page+1)
+}
+
+func adminPastesHandler(w http.ResponseWriter, r *http.Request) {
+	f, err := ParseAdminPasteFilter(r.URL.Query())
+	if err != nil {
+		panic(err)
+	}
+
+	pastes, err := adminPastes(f)
+	if err != nil {
+		panic(err)
+	}
+
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	pages := (len(pastes) + adminPastesPerPage - 1) / adminPastesPerPage
+	if page < 1 {
+		page = 1
+	} else if page > pages && pages > 0 {
+		page = pages
+	}
+
+	query := r.URL.Query()
+	query.Del("page")
+	start := (page - 1) * adminPastesPerPage
+	end := start + adminPastesPerPage
+	if end > len(pastes) {
+		end = len(pastes)
+	}
+	if start > end {
+		start = end
+	}
+
+	RenderPage(w, r, "admin_pastes", &AdminPastePage{
+		Pastes: pastes[start:end],
+		Total:  len(pastes),
+		Page:   page,
+		Pages:  pages,
+		Query:  query,
+	})
+}
+
+// adminPastesBulkHandler applies one action to every paste checked in the
+// browser: deleting it, clearing its reports, or giving it a new expiration.
+func adminPastesBulkHandler(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	action := r.PostFormValue("action")
+	expireIn := r.PostFormValue("expire")
+
+	var ids []PasteID
+	for _, id := range r.PostForm["id"] {
+		ids = append(ids, PasteIDFromString(id))
+	}
+
+	if len(ids) == 0 {
+		SetFlash(w, "error", "Select some pastes first.")
+	} else {
+		switch action {
+		case "delete":
+			perms := GetPastePermissions(r)
+			n := 0
+			for _, id := range ids {
+				p, _ := pasteStore.Get(id, nil)
+				if p == nil {
+					continue
+				}
+				if err := destroyPaste(p, perms); err != nil {
+					glog.Errorf("Failed to delete paste %v: %v", id, err)
+					continue
+				}
+				n++
+			}
+			perms.Save(w, r)
+			SetFlash(w, "success", fmt.Sprintf("Deleted %d of %d pastes.", n, len(ids)))
+			healthServer.IncrementMetric("admin.pastes.deleted")
+		case "clear_reports":
+			for _, id := range ids {
+				reportStore.Delete(id)
+			}
+			SetFlash(w, "success", fmt.Sprintf("Cleared the reports for %d pastes.", len(ids)))
+			healthServer.IncrementMetric("admin.pastes.reports_cleared")
+		case "expire":
+			if expireIn != "-1" && expireIn != BURN_AFTER_READING {
+				if dur, err := ParseDuration(expireIn); err != nil || dur <= 0 {
+					panic(PasteExpirationError("I don't understand how long you want those pastes to last."))
+				}
+			}
+
+			n := 0
+			for _, id := range ids {
+				p, _ := pasteStore.Get(id, nil)
+				if p == nil {
+					continue
+				}
+				// Chosen afresh, as it would be for a new paste: a paste that
+				// already lasts a day gets another day from now.
+				if err := updatePasteExpiration(p, expireIn, "", true); err != nil {
+					glog.Errorf("Failed to change the expiration of paste %v: %v", id, err)
+					continue
+				}
+				// Only the expiration is written, as an encrypted paste
+				// can't be saved without its key.
+				if err := p.store.storeExpiration(p); err != nil {
+					glog.Errorf("Failed to change the expiration of paste %v: %v", id, err)
+					continue
+				}
+				scheduleExpiration(p)
+				n++
+			}
+			SetFlash(w, "success", fmt.Sprintf("Changed the expiration of %d of %d pastes.", n, len(ids)))
+			healthServer.IncrementMetric("admin.pastes.expiration_changed")
+		default:
+			SetFlash(w, "error", "Choose what to do with those pastes.")
+		}
+	}
+
+	// Back to the same page of the same filter.
+	back := "/admin/pastes"
+	if q, err := url.ParseQuery(r.PostFormValue("query")); err == nil && len(q) > 0 {
+		back += "?" + q.Encode()
+	}
+	w.Header().Set("Location", back)
+	w.WriteHeader(http.StatusSeeOther)
+}
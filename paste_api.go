@@ -0,0 +1,658 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+// The API under /api/v1 offers everything the HTML routes do, taking and
+// returning JSON. Pastes are resources under /api/v1/pastes; what can be done
+// to one that isn't creating, reading, changing or deleting it (its password,
+// its expiration, granting it, reporting it) has a route of its own beneath
+// it. Requests are authorized by the same session cookies as the site's forms,
+// and every error comes back as {"error": {"status": ..., "message": ...}},
+// with the status it was answered with.
+
+const (
+	apiPastesPerPage    = 20
+	apiMaxPastesPerPage = 100
+
+	// apiRequestLimit bounds a request body, leaving room for the paste in it
+	// to have been escaped.
+	apiRequestLimit = 6*int64(PASTE_MAXIMUM_LENGTH) + 64*1024
+)
+
+// APIError is a request the API refuses, and the status it's refused with.
+type APIError struct {
+	Status  int
+	Message string
+}
+
+func (e APIError) Error() string {
+	return e.Message
+}
+
+func (e APIError) StatusCode() int {
+	return e.Status
+}
+
+func renderAPIError(e error, statusCode int, w http.ResponseWriter) {
+	writeAPIResponse(w, statusCode, map[string]interface{}{
+		"error": map[string]interface{}{
+			"status":  statusCode,
+			"message": e.Error(),
+		},
+	})
+}
+
+// apiErrorRecoveryHandler is errorRecoveryHandler for the API.
+func apiErrorRecoveryHandler(w http.ResponseWriter) {
+	if err := recover(); err != nil {
+		status := http.StatusInternalServerError
+		if weberr, ok := err.(HTTPError); ok {
+			status = weberr.StatusCode()
+		}
+
+		renderAPIError(err.(error), status, w)
+	}
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func decodeAPIRequest(w http.ResponseWriter, r *http.Request, v interface{}) {
+	body := http.MaxBytesReader(w, r.Body, apiRequestLimit)
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		panic(APIError{http.StatusBadRequest, "I don't understand that JSON: " + err.Error()})
+	}
+}
+
+func apiURL(r *http.Request, routeType string, pairs ...string) string {
+	u, _ := apiRouter.Get(routeType).URL(pairs...)
+	return BaseURLForRequest(r).ResolveReference(u).String()
+}
+
+func apiPasteURL(r *http.Request, routeType string, p *Paste) string {
+	return apiURL(r, routeType, "id", p.ID.String())
+}
+
+// siteURL makes path, one of the site's own, absolute.
+func siteURL(r *http.Request, path string) string {
+	u, _ := url.Parse(path)
+	return BaseURLForRequest(r).ResolveReference(u).String()
+}
+
+// apiPasteHandler looks up the paste named in the URL for fn, as
+// RequiredModelObjectHandler does. A paste that needs a password isn't sent
+// off to be authenticated; the client is told to do that itself.
+func apiPasteHandler(fn ModelRenderFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer apiErrorRecoveryHandler(w)
+
+		o, err := lookupPasteWithRequest(r)
+		if dle, ok := err.(DeferLookupError); ok {
+			id := mux.Vars(r)["id"]
+			if dle.Interstitial.RawQuery != "" {
+				panic(APIError{http.StatusUnauthorized, "The password you gave for paste " + id + " isn't right."})
+			}
+			panic(APIError{http.StatusUnauthorized, "Paste " + id + " has a password. Send it to " + apiURL(r, "api_authenticate", "id", id) + " first."})
+		} else if err != nil {
+			panic(err)
+		}
+		fn(o, w, r)
+	})
+}
+
+// apiRequiresEditPermission is requiresEditPermission for the API.
+func apiRequiresEditPermission(fn ModelRenderFunc) ModelRenderFunc {
+	return func(o Model, w http.ResponseWriter, r *http.Request) {
+		p := o.(*Paste)
+		if !isEditAllowed(p, r) {
+			panic(PasteAccessDeniedError{"modify", p.ID})
+		}
+		fn(p, w, r)
+	}
+}
+
+// apiRequiresOwnerPermission is requiresOwnerPermission for the API.
+func apiRequiresOwnerPermission(action string, fn ModelRenderFunc) ModelRenderFunc {
+	return func(o Model, w http.ResponseWriter, r *http.Request) {
+		p := o.(*Paste)
+		if !isOwnerAllowed(p, r) {
+			panic(PasteAccessDeniedError{action, p.ID})
+		}
+		fn(p, w, r)
+	}
+}
+
+// requireAPIPasteBase refuses a change to p made against a version named in
+// If-Match that p has since moved on from.
+func requireAPIPasteBase(p *Paste, w http.ResponseWriter, r *http.Request) {
+	if base := r.Header.Get("If-Match"); base != "" && !etagMatches(base, p.ETag()) {
+		w.Header().Set("ETag", p.ETag())
+		panic(APIError{http.StatusPreconditionFailed, PasteModifiedError{ID: p.ID}.Error()})
+	}
+}
+
+// apiPasteObject describes p, but not its body, to the API's clients.
+func apiPasteObject(p *Paste, r *http.Request) map[string]interface{} {
+	pasteMap := pasteJSONObject(p)
+	pasteMap["title"] = p.Title
+	pasteMap["etag"] = p.ETag()
+	pasteMap["created_at"] = p.CreationTime().UTC().Format(time.RFC3339)
+	pasteMap["modified_at"] = p.LastModified().UTC().Format(time.RFC3339)
+	pasteMap["editable"] = isEditAllowed(p, r)
+	pasteMap["url"] = apiPasteURL(r, "api_paste", p)
+	pasteMap["html_url"] = siteURL(r, pasteURL("show", p))
+	pasteMap["raw_url"] = siteURL(r, pasteURL("raw", p))
+	if p.Parent != "" {
+		pasteMap["parent"] = p.Parent
+	}
+	return pasteMap
+}
+
+type apiPasteFile struct {
+	Name     string `json:"name"`
+	Language string `json:"language"`
+	Body     string `json:"body"`
+}
+
+// apiPasteRequest is a paste as it's sent to be created or changed. Anything
+// left out of a change is left as it was; a paste's body is sent either whole,
+// in body, or as a list of files.
+type apiPasteRequest struct {
+	Body             *string        `json:"body"`
+	Files            []apiPasteFile `json:"files"`
+	Title            *string        `json:"title"`
+	Language         string         `json:"language"`
+	Visibility       string         `json:"visibility"`
+	Expiration       string         `json:"expiration"`
+	ExpiresAt        string         `json:"expires_at"`
+	MaxViews         int            `json:"max_views"`
+	Password         string         `json:"password"`
+	ClientEncryption *string        `json:"client_encryption"`
+}
+
+// body returns the body req asks for, and its files; ok is false if it
+// doesn't ask for one.
+func (req *apiPasteRequest) body() (body string, files []*PasteFile, ok bool) {
+	if req.Files == nil {
+		if req.Body == nil {
+			return "", nil, false
+		}
+		return *req.Body, nil, true
+	}
+
+	if req.Body != nil {
+		panic(APIError{http.StatusBadRequest, "A paste can be sent as a body or as files, but not both."})
+	}
+
+	texts := make([]string, len(req.Files))
+	names := make([]string, len(req.Files))
+	langs := make([]string, len(req.Files))
+	for i, f := range req.Files {
+		texts[i], names[i], langs[i] = f.Body, f.Name, f.Language
+	}
+	body, files = pasteBodyFromFiles(texts, names, langs)
+	return body, files, true
+}
+
+// options returns everything about req but its body as the options of an
+// upload, for applyPasteUploadOptions.
+func (req *apiPasteRequest) options() url.Values {
+	opts := url.Values{}
+	set := func(name, value string) {
+		if value != "" {
+			opts.Set(name, value)
+		}
+	}
+	set("lang", req.Language)
+	set("visibility", req.Visibility)
+	set("expire", req.Expiration)
+	set("expire_at", req.ExpiresAt)
+	if req.Title != nil {
+		opts.Set("title", *req.Title)
+	}
+	if req.MaxViews != 0 {
+		opts.Set("max_views", strconv.Itoa(req.MaxViews))
+	}
+	return opts
+}
+
+func checkAPIPasteBody(body string, files []*PasteFile, clientEncryption string) {
+	if len(strings.TrimSpace(body)) == 0 {
+		panic(APIError{http.StatusBadRequest, "Hey, put some text in that paste."})
+	}
+
+	pasteLen := ByteSize(len(body))
+	if pasteLen > PASTE_MAXIMUM_LENGTH {
+		panic(PasteTooLargeError(pasteLen))
+	}
+
+	if err := checkClientEncryption(clientEncryption, body, files); err != nil {
+		panic(err)
+	}
+}
+
+// writeAPIPaste saves body, and everything else req asks for, to p.
+func writeAPIPaste(p *Paste, req *apiPasteRequest, body string, files []*PasteFile, newPaste bool) {
+	pw, err := p.Writer()
+	if err != nil {
+		panic(err)
+	}
+	if _, err := pw.Write([]byte(body)); err != nil {
+		pw.Abort()
+		panic(err)
+	}
+	if err := applyPasteUploadOptions(p, req.options(), files, newPaste); err != nil {
+		pw.Abort()
+		panic(err)
+	}
+
+	// The real title and language are encrypted along with the body.
+	if p.ClientEncryption != "" {
+		p.Language, p.Title = LanguageNamed("text"), ""
+	}
+
+	if err := pw.Close(); err != nil { // Saves p
+		panic(err)
+	}
+}
+
+// apiPastesHandler lists pastes a page at a time: the public ones, or with
+// scope=mine those the requester can edit or owns, newest first. Only those
+// matching q are listed, if it's given.
+func apiPastesHandler(w http.ResponseWriter, r *http.Request) {
+	defer apiErrorRecoveryHandler(w)
+
+	var pastes []*Paste
+	switch scope := r.FormValue("scope"); scope {
+	case "", "public":
+		pastes = pasteListing.Public(0)
+	case "mine":
+		pastes = sessionPastes(r)
+	default:
+		panic(APIError{http.StatusBadRequest, "Pastes can be listed from the public scope or from mine, but not from " + scope + "."})
+	}
+
+	if q := ParsePasteSearchQuery(r.FormValue("q")); !q.Empty() {
+		pastes = pasteIndex.Search(pastes, q)
+	}
+
+	page, perPage := 1, apiPastesPerPage
+	if v := r.FormValue("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			panic(APIError{http.StatusBadRequest, "Pages are numbered from 1."})
+		}
+		page = n
+	}
+	if v := r.FormValue("per_page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > apiMaxPastesPerPage {
+			panic(APIError{http.StatusBadRequest, fmt.Sprintf("A page can list between 1 and %d pastes.", apiMaxPastesPerPage)})
+		}
+		perPage = n
+	}
+
+	start := (page - 1) * perPage
+	end := start + perPage
+	if end > len(pastes) {
+		end = len(pastes)
+	}
+	if start > end {
+		start = end
+	}
+
+	objects := make([]map[string]interface{}, 0, end-start)
+	for _, p := range pastes[start:end] {
+		objects = append(objects, apiPasteObject(p, r))
+	}
+
+	pageURL := func(n int) string {
+		query := r.URL.Query()
+		query.Set("page", strconv.Itoa(n))
+		u := apiURL(r, "api_pastes")
+		return u + "?" + query.Encode()
+	}
+
+	list := map[string]interface{}{
+		"pastes":   objects,
+		"page":     page,
+		"per_page": perPage,
+		"pages":    (len(pastes) + perPage - 1) / perPage,
+		"total":    len(pastes),
+	}
+	if end < len(pastes) {
+		list["next"] = pageURL(page + 1)
+	}
+	if page > 1 {
+		list["previous"] = pageURL(page - 1)
+	}
+	writeAPIResponse(w, http.StatusOK, list)
+}
+
+// apiPasteCreate makes a new paste, which the requester can then edit, and
+// answers with it and where to find it.
+func apiPasteCreate(w http.ResponseWriter, r *http.Request) {
+	defer apiErrorRecoveryHandler(w)
+
+	var req apiPasteRequest
+	decodeAPIRequest(w, r, &req)
+
+	body, files, ok := req.body()
+	if !ok {
+		panic(APIError{http.StatusBadRequest, "Hey, put some text in that paste."})
+	}
+
+	clientEncryption := ""
+	if req.ClientEncryption != nil {
+		clientEncryption = *req.ClientEncryption
+	}
+	checkAPIPasteBody(body, files, clientEncryption)
+
+	encrypted := req.Password != ""
+	if encrypted && (Env() != EnvironmentDevelopment && !RequestIsHTTPS(r)) {
+		panic(PastePasswordError("I refuse to accept passwords over HTTP."))
+	}
+	if encrypted && clientEncryption != "" {
+		panic(PasteClientEncryptionError("A paste can't have a password and be encrypted by the client."))
+	}
+
+	p, err := pasteStore.New(encrypted)
+	if err != nil {
+		panic(err)
+	}
+
+	key := p.EncryptionKeyWithPassword(req.Password)
+	p.SetEncryptionKey(key)
+	p.ClientEncryption = clientEncryption
+	p.Owner = requestOwner(r)
+
+	writeAPIPaste(p, &req, body, files, true)
+
+	perms := GetPastePermissions(r)
+	perms.Put(p.ID, PastePermission{"edit": true, "grant": true})
+	perms.Save(w, r)
+	if key != nil {
+		rememberPasteKey(r, p.ID, key)
+	}
+	if err := sessions.Save(r, w); err != nil {
+		glog.Errorln(err)
+	}
+
+	healthServer.IncrementMetric("paste.created")
+	w.Header().Set("Location", apiPasteURL(r, "api_paste", p))
+	w.Header().Set("ETag", p.ETag())
+	writeAPIResponse(w, http.StatusCreated, apiPasteObject(p, r))
+}
+
+// apiPasteShow answers with a paste and its body, burning it or counting the
+// view as its page would.
+func apiPasteShow(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	w.Header().Set("ETag", p.ETag())
+	if tags := r.Header.Get("If-None-Match"); tags != "" && etagMatches(tags, p.ETag()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	revealPastes(p, r, func() bool {
+		reader, err := p.Reader()
+		if err != nil {
+			panic(err)
+		}
+		defer reader.Close()
+
+		body, err := ioutil.ReadAll(reader)
+		if err != nil {
+			panic(err)
+		}
+
+		pasteMap := apiPasteObject(p, r)
+		pasteMap["body"] = string(body)
+		writeAPIResponse(w, http.StatusOK, pasteMap)
+		return true
+	})
+}
+
+// apiPasteUpdate changes whatever of a paste the request mentions; a change
+// that leaves the body out keeps the one it has. Either way, the paste gains
+// a revision.
+func apiPasteUpdate(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	requireAPIPasteBase(p, w, r)
+
+	var req apiPasteRequest
+	decodeAPIRequest(w, r, &req)
+
+	if req.Password != "" {
+		panic(PastePasswordError("Change the password of paste " + p.ID.String() + " at " + apiPasteURL(r, "api_password", p) + "."))
+	}
+	if req.MaxViews != 0 {
+		panic(PasteViewLimitError("A paste's view limit can only be chosen when it's created."))
+	}
+	if req.ClientEncryption != nil && *req.ClientEncryption != p.ClientEncryption {
+		panic(PasteClientEncryptionError("Client-side encryption can't be turned on or off once a paste exists."))
+	}
+
+	body, files, ok := req.body()
+	if ok {
+		checkAPIPasteBody(body, files, p.ClientEncryption)
+		if files == nil {
+			// A body on its own makes a paste of one file, as the editor does.
+			p.Files = nil
+		}
+	} else {
+		reader, err := p.Reader()
+		if err != nil {
+			panic(err)
+		}
+		current, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			panic(err)
+		}
+		body, files = string(current), p.Files
+	}
+
+	writeAPIPaste(p, &req, body, files, false)
+
+	healthServer.IncrementMetric("paste.updated")
+	w.Header().Set("ETag", p.ETag())
+	writeAPIResponse(w, http.StatusOK, apiPasteObject(p, r))
+}
+
+func apiPasteDelete(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	requireAPIPasteBase(p, w, r)
+
+	perms := GetPastePermissions(r)
+	if err := destroyPaste(p, perms); err != nil {
+		panic(err)
+	}
+	perms.Save(w, r)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// apiPasteRevisions lists a paste's revisions, oldest first.
+func apiPasteRevisions(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	revs, err := p.Revisions()
+	if err != nil {
+		panic(err)
+	}
+
+	objects := make([]map[string]interface{}, 0, len(revs))
+	for _, rev := range revs {
+		objects = append(objects, map[string]interface{}{
+			"number":      rev.Number,
+			"title":       rev.Title,
+			"language":    rev.Language,
+			"etag":        rev.ETag(),
+			"modified_at": rev.LastModified().UTC().Format(time.RFC3339),
+			"raw_url":     siteURL(r, revisionURL("revision_raw", rev)),
+		})
+	}
+	writeAPIResponse(w, http.StatusOK, map[string]interface{}{"revisions": objects})
+}
+
+func apiPasteFork(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	revealPastes(p, r, func() bool {
+		fork := forkPaste(p, w, r)
+		w.Header().Set("Location", apiPasteURL(r, "api_paste", fork))
+		w.Header().Set("ETag", fork.ETag())
+		writeAPIResponse(w, http.StatusCreated, apiPasteObject(fork, r))
+		return true
+	})
+}
+
+type apiPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+// apiPasteAuthenticate keeps the key for a paste with a password in the
+// requester's session, once it's been given the right password.
+func apiPasteAuthenticate(w http.ResponseWriter, r *http.Request) {
+	defer apiErrorRecoveryHandler(w)
+
+	if throttleAuthForRequest(r) {
+		panic(APIError{http.StatusTooManyRequests, "Cool it."})
+	}
+
+	var req apiPasswordRequest
+	decodeAPIRequest(w, r, &req)
+
+	id := PasteIDFromString(mux.Vars(r)["id"])
+	p, err := pasteStore.Get(id, nil)
+	if p != nil && !isPasteVisible(p, r) {
+		p, err = nil, PasteNotFoundError{ID: id}
+	}
+	if p == nil {
+		panic(err)
+	}
+	if !p.Encrypted {
+		panic(PastePasswordError(fmt.Sprintf("Paste %v doesn't have a password.", p.ID)))
+	}
+
+	key := p.EncryptionKeyWithPassword(req.Password)
+	p, err = pasteStore.Get(id, key)
+	if err != nil {
+		switch err.(type) {
+		case PasteEncryptedError, PasteInvalidKeyError:
+			panic(APIError{http.StatusUnauthorized, "The password you gave for paste " + id.String() + " isn't right."})
+		}
+		panic(err)
+	}
+
+	rememberPasteKey(r, id, key)
+	if err := sessions.Save(r, w); err != nil {
+		glog.Errorln(err)
+	}
+
+	healthServer.IncrementMetric("paste.auth.successful")
+	writeAPIResponse(w, http.StatusOK, apiPasteObject(p, r))
+}
+
+// apiPastePasswordChange gives a paste a new password, or takes it away if
+// the new one is blank.
+func apiPastePasswordChange(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+
+	var req apiPasswordRequest
+	decodeAPIRequest(w, r, &req)
+
+	changePastePassword(p, req.Password, w, r)
+	writeAPIResponse(w, http.StatusOK, apiPasteObject(p, r))
+}
+
+type apiExpirationRequest struct {
+	Extend string `json:"extend"`
+	Cancel bool   `json:"cancel"`
+}
+
+func apiPasteExpirationChange(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+
+	var req apiExpirationRequest
+	decodeAPIRequest(w, r, &req)
+
+	changePasteExpiration(p, req.Extend, req.Cancel)
+	writeAPIResponse(w, http.StatusOK, apiPasteObject(p, r))
+}
+
+// apiPasteGrant makes a grant of edit rights to a paste, to be handed to
+// somebody else.
+func apiPasteGrant(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+
+	grantKey := grantStore.NewGrant(p.ID)
+	acceptURL, _ := pasteRouter.Get("grant_accept").URL("grantkey", string(grantKey))
+
+	healthServer.IncrementMetric("grants.generated")
+	writeAPIResponse(w, http.StatusCreated, map[string]string{
+		"key":            string(grantKey),
+		"id":             p.ID.String(),
+		"accept_url":     BaseURLForRequest(r).ResolveReference(acceptURL).String(),
+		"api_accept_url": apiURL(r, "api_grant_accept", "grantkey", string(grantKey)),
+	})
+}
+
+func apiGrantAccept(w http.ResponseWriter, r *http.Request) {
+	defer apiErrorRecoveryHandler(w)
+
+	pID, ok := acceptGrant(GrantID(mux.Vars(r)["grantkey"]), w, r)
+	if !ok {
+		panic(APIError{http.StatusNotFound, "That grant doesn't exist, or has already been used."})
+	}
+
+	writeAPIResponse(w, http.StatusOK, map[string]string{
+		"id":  pID.String(),
+		"url": apiURL(r, "api_paste", "id", pID.String()),
+	})
+}
+
+func apiPasteDisavow(o Model, w http.ResponseWriter, r *http.Request) {
+	disavowPaste(o.(*Paste), w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type apiReportRequest struct {
+	Reason string `json:"reason"`
+}
+
+func apiPasteReport(o Model, w http.ResponseWriter, r *http.Request) {
+	if throttleAuthForRequest(r) {
+		panic(APIError{http.StatusTooManyRequests, "Cool it."})
+	}
+
+	p := o.(*Paste)
+
+	var req apiReportRequest
+	decodeAPIRequest(w, r, &req)
+	if strings.TrimSpace(req.Reason) == "" {
+		panic(APIError{http.StatusBadRequest, "Say why you're reporting that paste."})
+	}
+
+	reportStore.Add(p.ID, req.Reason)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiNotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	renderAPIError(fmt.Errorf("There's nothing at %s.", r.URL.Path), http.StatusNotFound, w)
+}
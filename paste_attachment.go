@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// PasteAttachment is a file of any kind (a core dump, a screenshot, a
+// tarball) attached to a paste, and downloaded just as it was uploaded.
+// Attachments stand apart from the paste's body: they aren't part of its
+// revisions, and editing the paste leaves them be. They're encrypted with the
+// paste's key, if it has one.
+type PasteAttachment struct {
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	Length int64  `json:"length"`
+
+	paste            *Paste
+	key              string
+	mtime            time.Time
+	encryptionMethod string
+}
+
+type PasteAttachmentNotFoundError struct {
+	ID   PasteID
+	Name string
+}
+
+func (e PasteAttachmentNotFoundError) Error() string {
+	return fmt.Sprintf("Paste %v has no attachment named %s.", e.ID, e.Name)
+}
+
+// attachmentEncryptionMethod is the only method attachments are encrypted
+// with; unlike bodies, none were ever encrypted with anything older.
+const attachmentEncryptionMethod = "3"
+
+// previewableAttachmentTypes are the types of image that are safe to show
+// inline. SVG, which can carry script, is deliberately absent.
+var previewableAttachmentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+func (a *PasteAttachment) Paste() *Paste {
+	return a.paste
+}
+
+func (a *PasteAttachment) LastModified() time.Time {
+	return a.mtime
+}
+
+// Previewable reports whether a is an image that can be shown inline.
+func (a *PasteAttachment) Previewable() bool {
+	mediaType, _, _ := mime.ParseMediaType(a.Type)
+	return previewableAttachmentTypes[mediaType]
+}
+
+func (a *PasteAttachment) Reader() (*PasteReader, error) {
+	return a.paste.store.readAttachmentStream(a)
+}
+
+func (a *PasteAttachment) Destroy() error {
+	return a.paste.store.destroyAttachment(a)
+}
+
+// Attachments returns every attachment of p, oldest first.
+func (p *Paste) Attachments() ([]*PasteAttachment, error) {
+	return p.store.Attachments(p)
+}
+
+func (p *Paste) Attachment(name string) (*PasteAttachment, error) {
+	attachments, err := p.Attachments()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range attachments {
+		if a.Name == name {
+			return a, nil
+		}
+	}
+	return nil, PasteAttachmentNotFoundError{ID: p.ID, Name: name}
+}
+
+// attachmentType works out what an attachment is from its name or, failing
+// that, from what its uploader said it was.
+func attachmentType(name, declared string) string {
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t
+	}
+	if mediaType, params, err := mime.ParseMediaType(declared); err == nil {
+		return mime.FormatMediaType(mediaType, params)
+	}
+	return "application/octet-stream"
+}
+
+// PasteAttachmentWriter writes a new attachment. Nothing is attached until
+// it's closed, at which point its name is made unique among the paste's
+// other attachments.
+type PasteAttachmentWriter struct {
+	io.WriteCloser
+	attachment *PasteAttachment
+	body       pasteBodyWriter
+}
+
+// NewAttachment starts a new attachment to p called name, of the given type.
+func (p *Paste) NewAttachment(name, contentType string) (*PasteAttachmentWriter, error) {
+	if p.ClientEncryption != "" {
+		return nil, PasteClientEncryptionError("Client-encrypted pastes can't have attachments.")
+	}
+
+	// Without its key, the attachment would be sealed with a key of nothing.
+	if p.Encrypted && p.encryptionKey == nil {
+		return nil, PasteEncryptedError{ID: p.ID}
+	}
+
+	key, err := generateRandomBase32String(10, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	name = cleanFileName(name)
+	if name == "" {
+		name = "attachment"
+	}
+
+	a := &PasteAttachment{Name: name, Type: contentType, paste: p, key: key}
+	body, err := p.store.writeAttachmentStream(a)
+	if err != nil {
+		return nil, err
+	}
+	return &PasteAttachmentWriter{WriteCloser: encryptedAttachmentWriter(a, body), attachment: a, body: body}, nil
+}
+
+func (aw *PasteAttachmentWriter) Write(b []byte) (int, error) {
+	n, err := aw.WriteCloser.Write(b)
+	aw.attachment.Length += int64(n)
+	return n, err
+}
+
+// Abort throws away everything written so far, attaching nothing.
+func (aw *PasteAttachmentWriter) Abort() error {
+	return aw.body.Abort()
+}
+
+// Attachment is the attachment being written; its name is only settled once
+// the writer is closed.
+func (aw *PasteAttachmentWriter) Attachment() *PasteAttachment {
+	return aw.attachment
+}
+
+// authenticatedData ties a's encryption to a, so that it can't be passed off
+// as the body of its paste or another of its attachments.
+func (a *PasteAttachment) authenticatedData() []byte {
+	return []byte("attachment|" + a.paste.ID.String() + "|" + a.key)
+}
+
+func encryptedAttachmentWriter(a *PasteAttachment, w io.WriteCloser) io.WriteCloser {
+	a.encryptionMethod = ""
+	if !a.paste.Encrypted {
+		return w
+	}
+
+	a.encryptionMethod = attachmentEncryptionMethod
+	return newGCMChunkWriterWithData(a.paste, a.authenticatedData(), w)
+}
+
+func encryptedAttachmentReader(a *PasteAttachment, r io.ReadCloser) (io.ReadCloser, error) {
+	switch a.encryptionMethod {
+	case "":
+		return r, nil
+	case attachmentEncryptionMethod:
+		if a.paste.encryptionKey == nil {
+			r.Close()
+			return nil, PasteEncryptedError{ID: a.paste.ID}
+		}
+		return newGCMChunkReaderWithData(a.paste, a.authenticatedData(), r), nil
+	}
+	r.Close()
+	return nil, fmt.Errorf("attachment %s of paste %v uses unknown encryption method %q", a.Name, a.paste.ID, a.encryptionMethod)
+}
+
+// encryptAttachmentBody returns body as a's store would write it.
+func encryptAttachmentBody(a *PasteAttachment, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := encryptedAttachmentWriter(a, nopWriteCloser{&buf})
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decryptedAttachments reads every attachment of p in the clear, so that they
+// can be written back under a new key.
+func decryptedAttachments(p *Paste) ([]*PasteAttachment, [][]byte, error) {
+	attachments, err := p.Attachments()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bodies := make([][]byte, len(attachments))
+	for i, a := range attachments {
+		if bodies[i], err = readPasteBody(a.Reader()); err != nil {
+			return nil, nil, err
+		}
+	}
+	return attachments, bodies, nil
+}
+
+// uniqueAttachmentName numbers a's name, if need be, so that no other
+// attachment in attachments has it.
+func uniqueAttachmentName(a *PasteAttachment, attachments []*PasteAttachment) string {
+	taken := make(map[string]bool)
+	for _, other := range attachments {
+		if other.key != a.key {
+			taken[other.Name] = true
+		}
+	}
+	return uniqueFileName(a.Name, taken)
+}
+
+// loadMetadata populates a from a store's metadata for the attachment.
+func (a *PasteAttachment) loadMetadata(get metadataGetter) {
+	a.Name = get("name", a.key)
+	a.Type = get("content_type", "application/octet-stream")
+	a.Length, _ = strconv.ParseInt(get("length", "0"), 10, 64)
+	a.encryptionMethod = get("encryption_version", "")
+}
+
+// metadata returns the metadata a store needs to keep for a.
+func (a *PasteAttachment) metadata() map[string]string {
+	md := map[string]string{
+		"name":         a.Name,
+		"content_type": a.Type,
+		"length":       strconv.FormatInt(a.Length, 10),
+	}
+	if a.encryptionMethod != "" {
+		md["encryption_version"] = a.encryptionMethod
+	}
+	return md
+}
+
+func (store *FilesystemPasteStore) attachmentDirectoryForID(id PasteID) string {
+	return store.locate(id, ".attachments")
+}
+
+func (store *FilesystemPasteStore) attachmentFilename(a *PasteAttachment) string {
+	return filepath.Join(store.attachmentDirectoryForID(a.paste.ID), a.key)
+}
+
+func (store *FilesystemPasteStore) Attachments(p *Paste) ([]*PasteAttachment, error) {
+	dir, err := os.Open(store.attachmentDirectoryForID(p.ID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	var attachments []*PasteAttachment
+	for _, name := range names {
+		// Sidecars and files that are still being written carry an extension.
+		if filepath.Ext(name) != "" {
+			continue
+		}
+
+		a := &PasteAttachment{paste: p, key: name}
+		filename := store.attachmentFilename(a)
+		stat, err := os.Stat(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed since we listed the directory.
+				continue
+			}
+			return nil, err
+		}
+
+		md, err := store.loadMetadata(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		a.mtime = stat.ModTime()
+		a.loadMetadata(func(name string, dflt string) string {
+			if v, ok := md[name]; ok {
+				return v
+			}
+			return dflt
+		})
+		attachments = append(attachments, a)
+	}
+
+	sort.Slice(attachments, func(i, j int) bool {
+		if !attachments[i].mtime.Equal(attachments[j].mtime) {
+			return attachments[i].mtime.Before(attachments[j].mtime)
+		}
+		return attachments[i].key < attachments[j].key
+	})
+	return attachments, nil
+}
+
+func (store *FilesystemPasteStore) readAttachmentStream(a *PasteAttachment) (*PasteReader, error) {
+	file, err := os.Open(store.attachmentFilename(a))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, PasteAttachmentNotFoundError{ID: a.paste.ID, Name: a.Name}
+		}
+		return nil, err
+	}
+
+	r, err := encryptedAttachmentReader(a, file)
+	if err != nil {
+		return nil, err
+	}
+	return &PasteReader{ReadCloser: r, paste: a.paste}, nil
+}
+
+// filesystemAttachmentWriter writes an attachment beside the others, where
+// it's ignored until it's complete and renamed into place.
+type filesystemAttachmentWriter struct {
+	*os.File
+	store      *FilesystemPasteStore
+	attachment *PasteAttachment
+}
+
+func (store *FilesystemPasteStore) writeAttachmentStream(a *PasteAttachment) (pasteBodyWriter, error) {
+	dir := store.attachmentDirectoryForID(a.paste.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	file, err := ioutil.TempFile(dir, a.key+".")
+	if err != nil {
+		return nil, err
+	}
+	return &filesystemAttachmentWriter{File: file, store: store, attachment: a}, nil
+}
+
+func (w *filesystemAttachmentWriter) Close() error {
+	err := w.File.Close()
+	if err == nil {
+		err = w.store.addAttachment(w.Name(), w.attachment)
+	}
+	if err != nil {
+		w.store.removeReplacementFile(w.Name())
+	}
+	return err
+}
+
+func (w *filesystemAttachmentWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.Name())
+}
+
+// addAttachment moves name, the complete body of a, into place.
+func (store *FilesystemPasteStore) addAttachment(name string, a *PasteAttachment) error {
+	// Serialized, so that two attachments can't settle on the same name.
+	store.metadataLock.Lock()
+	defer store.metadataLock.Unlock()
+
+	if _, err := os.Stat(store.filenameForID(a.paste.ID)); err != nil {
+		return PasteNotFoundError{ID: a.paste.ID}
+	}
+
+	attachments, err := store.Attachments(a.paste)
+	if err != nil {
+		return err
+	}
+	a.Name = uniqueAttachmentName(a, attachments)
+
+	if err := store.metadata.Store(name, a.metadata()); err != nil {
+		return err
+	}
+	if err := store.replaceFile(name, store.attachmentFilename(a)); err != nil {
+		return err
+	}
+	a.mtime = time.Now()
+	return nil
+}
+
+func (store *FilesystemPasteStore) destroyAttachment(a *PasteAttachment) error {
+	filename := store.attachmentFilename(a)
+	if err := os.Remove(filename); err != nil {
+		if os.IsNotExist(err) {
+			return PasteAttachmentNotFoundError{ID: a.paste.ID, Name: a.Name}
+		}
+		return err
+	}
+	sidecarMetadataBackend{}.Remove(filename)
+	return nil
+}
+
+func (store *SQLitePasteStore) Attachments(p *Paste) ([]*PasteAttachment, error) {
+	rows, err := store.db.Query("SELECT id, name, content_type, length, encryption_version, mtime FROM paste_attachments WHERE paste_id = ? ORDER BY mtime, id", p.ID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var attachments []*PasteAttachment
+	for rows.Next() {
+		a := &PasteAttachment{paste: p}
+		var mtime int64
+		if err := rows.Scan(&a.key, &a.Name, &a.Type, &a.Length, &a.encryptionMethod, &mtime); err != nil {
+			return nil, err
+		}
+		a.mtime = time.Unix(0, mtime)
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+func (store *SQLitePasteStore) readAttachmentStream(a *PasteAttachment) (*PasteReader, error) {
+	var body []byte
+	err := store.db.QueryRow("SELECT body FROM paste_attachments WHERE paste_id = ? AND id = ?", a.paste.ID.String(), a.key).Scan(&body)
+	if err == sql.ErrNoRows {
+		return nil, PasteAttachmentNotFoundError{ID: a.paste.ID, Name: a.Name}
+	} else if err != nil {
+		return nil, err
+	}
+
+	r, err := encryptedAttachmentReader(a, ioutil.NopCloser(bytes.NewReader(body)))
+	if err != nil {
+		return nil, err
+	}
+	return &PasteReader{ReadCloser: r, paste: a.paste}, nil
+}
+
+// sqliteAttachmentWriter buffers an attachment and adds it to the database
+// when closed.
+type sqliteAttachmentWriter struct {
+	sqliteBodyBuffer
+	store      *SQLitePasteStore
+	attachment *PasteAttachment
+}
+
+func (store *SQLitePasteStore) writeAttachmentStream(a *PasteAttachment) (pasteBodyWriter, error) {
+	return &sqliteAttachmentWriter{sqliteBodyBuffer: sqliteBodyBuffer{limit: store.BodyLimit}, store: store, attachment: a}, nil
+}
+
+func (w *sqliteAttachmentWriter) Close() error {
+	a := w.attachment
+	tx, err := w.store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var n int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM pastes WHERE id = ?", a.paste.ID.String()).Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return PasteNotFoundError{ID: a.paste.ID}
+	}
+
+	rows, err := tx.Query("SELECT id, name FROM paste_attachments WHERE paste_id = ?", a.paste.ID.String())
+	if err != nil {
+		return err
+	}
+	var attachments []*PasteAttachment
+	for rows.Next() {
+		other := &PasteAttachment{}
+		if err := rows.Scan(&other.key, &other.Name); err != nil {
+			rows.Close()
+			return err
+		}
+		attachments = append(attachments, other)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	a.Name = uniqueAttachmentName(a, attachments)
+
+	mtime := time.Now()
+	_, err = tx.Exec("INSERT INTO paste_attachments (paste_id, id, name, content_type, length, encryption_version, body, mtime) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		a.paste.ID.String(), a.key, a.Name, a.Type, a.Length, a.encryptionMethod, w.Bytes(), mtime.UnixNano())
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	a.mtime = mtime
+	return nil
+}
+
+func (w *sqliteAttachmentWriter) Abort() error {
+	w.Reset()
+	return nil
+}
+
+func (store *SQLitePasteStore) destroyAttachment(a *PasteAttachment) error {
+	res, err := store.db.Exec("DELETE FROM paste_attachments WHERE paste_id = ? AND id = ?", a.paste.ID.String(), a.key)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return PasteAttachmentNotFoundError{ID: a.paste.ID, Name: a.Name}
+	}
+	return nil
+}
+
+// importFilesystemAttachments copies the attachments of the paste with the
+// given ID out of fsStore, byte-for-byte.
+func (store *SQLitePasteStore) importFilesystemAttachments(tx *sql.Tx, fsStore *FilesystemPasteStore, id PasteID) error {
+	attachments, err := fsStore.Attachments(&Paste{ID: id})
+	if err != nil {
+		return err
+	}
+
+	for _, a := range attachments {
+		body, err := ioutil.ReadFile(fsStore.attachmentFilename(a))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO paste_attachments (paste_id, id, name, content_type, length, encryption_version, body, mtime) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			id.String(), a.key, a.Name, a.Type, a.Length, a.encryptionMethod, body, a.mtime.UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// With deduplication on, the filesystem store keeps the body of every
+// unencrypted paste just once, in a blob named for the SHA-256 of its bytes as
+// stored. The paste file itself is left empty, and its "blob" metadata names
+// the blob its body is in; the same goes for its revisions.
+//
+// Each blob has a set of references: the ID of every paste whose body it is,
+// and id.n for every revision n it's the body of. A paste releases its
+// reference when it's edited to something else or destroyed, and its
+// revisions release theirs when they're destroyed along with it. Blobs nobody
+// refers to any longer are removed by CollectBlobs.
+//
+// Blobs written with deduplication on stay readable after it's turned off.
+
+// blobGracePeriod is how long a blob, or a reference to one, is left alone by
+// CollectBlobs after it's written. A reference is made before the paste that
+// holds it is written, and would otherwise look stale in between.
+const blobGracePeriod = time.Hour
+
+const blobReferencesSuffix = ".refs"
+
+func (store *FilesystemPasteStore) blobDirectory() string {
+	return filepath.Join(store.path, "blobs")
+}
+
+func (store *FilesystemPasteStore) blobFilename(sum string) string {
+	if len(sum) < 2 {
+		return filepath.Join(store.blobDirectory(), sum)
+	}
+	return filepath.Join(store.blobDirectory(), sum[:2], sum)
+}
+
+func pasteBlobReferrer(id PasteID) string {
+	return id.String()
+}
+
+func revisionBlobReferrer(id PasteID, n int) string {
+	return id.String() + "." + strconv.Itoa(n)
+}
+
+func (store *FilesystemPasteStore) addBlobReference(sum, referrer string) error {
+	dir := store.blobFilename(sum) + blobReferencesSuffix
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, referrer), os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (store *FilesystemPasteStore) releaseBlobReference(sum, referrer string) {
+	err := os.Remove(filepath.Join(store.blobFilename(sum)+blobReferencesSuffix, referrer))
+	if err != nil && !os.IsNotExist(err) {
+		glog.Errorf("Failed to release %s's reference to blob %s: %v", referrer, sum, err)
+	}
+}
+
+// addBlob moves name, a body whose SHA-256 is sum, into the blob named for
+// it, unless there already is one.
+func (store *FilesystemPasteStore) addBlob(name, sum string) error {
+	filename := store.blobFilename(sum)
+
+	// Touched, to keep it from being collected out from under the new reference.
+	now := time.Now()
+	err := os.Chtimes(filename, now, now)
+	if err == nil {
+		return os.Remove(name)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	return os.Rename(name, filename)
+}
+
+// storeBlob moves name, the new body of the paste with the given ID, into the
+// blob for sum, referring to it from the paste. It returns the name of an
+// empty file to put in place of the paste file.
+func (store *FilesystemPasteStore) storeBlob(name string, id PasteID, sum string) (string, error) {
+	if err := store.addBlobReference(sum, pasteBlobReferrer(id)); err != nil {
+		return "", err
+	}
+	if err := store.addBlob(name, sum); err != nil {
+		return "", err
+	}
+
+	empty, err := ioutil.TempFile(store.path, id.String()+".")
+	if err != nil {
+		return "", err
+	}
+	return empty.Name(), empty.Close()
+}
+
+// bodyFilename is where the body of the paste (or revision) stored at
+// filename really is, given the blob its metadata names.
+func (store *FilesystemPasteStore) bodyFilename(filename, blob string) string {
+	if blob != "" {
+		return store.blobFilename(blob)
+	}
+	return filename
+}
+
+// blobReferences finds every blob the paste with the given ID, and each of its
+// revisions, refers to, by referrer.
+func (store *FilesystemPasteStore) blobReferences(id PasteID) map[string]string {
+	refs := make(map[string]string)
+	if md, err := store.loadMetadata(store.filenameForID(id)); err == nil && md["blob"] != "" {
+		refs[pasteBlobReferrer(id)] = md["blob"]
+	}
+
+	numbers, _ := store.revisionNumbers(id)
+	for _, n := range numbers {
+		filename := filepath.Join(store.revisionDirectoryForID(id), strconv.Itoa(n))
+		if md, err := store.loadMetadata(filename); err == nil && md["blob"] != "" {
+			refs[revisionBlobReferrer(id, n)] = md["blob"]
+		}
+	}
+	return refs
+}
+
+func (store *FilesystemPasteStore) releaseBlobReferences(refs map[string]string) {
+	for referrer, sum := range refs {
+		store.releaseBlobReference(sum, referrer)
+	}
+}
+
+// blobReferenceIsLive reports whether referrer still has its body in the blob for sum.
+func (store *FilesystemPasteStore) blobReferenceIsLive(sum, referrer string) bool {
+	filename := store.filenameForID(PasteIDFromString(referrer))
+	if i := strings.Index(referrer, "."); i >= 0 {
+		n, err := strconv.Atoi(referrer[i+1:])
+		if err != nil {
+			return false
+		}
+		filename = filepath.Join(store.revisionDirectoryForID(PasteIDFromString(referrer[:i])), strconv.Itoa(n))
+	}
+
+	if _, err := os.Stat(filename); err != nil {
+		return false
+	}
+	md, err := store.loadMetadata(filename)
+	return err == nil && md["blob"] == sum
+}
+
+// CollectBlobs removes every blob nothing refers to any more, along with
+// references left behind by pastes that have since moved on or gone away
+// without releasing them.
+func (store *FilesystemPasteStore) CollectBlobs() (int, error) {
+	shards, err := ioutil.ReadDir(store.blobDirectory())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	n := 0
+	for _, shard := range shards {
+		if !shard.IsDir() {
+			continue
+		}
+
+		fis, err := ioutil.ReadDir(filepath.Join(store.blobDirectory(), shard.Name()))
+		if err != nil {
+			return n, err
+		}
+
+		for _, fi := range fis {
+			if !fi.Mode().IsRegular() || filepath.Ext(fi.Name()) != "" {
+				continue
+			}
+
+			collected, err := store.collectBlob(fi.Name())
+			if err != nil {
+				glog.Errorf("Failed to collect blob %s: %v", fi.Name(), err)
+			}
+			if collected {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+func (store *FilesystemPasteStore) collectBlob(sum string) (bool, error) {
+	filename := store.blobFilename(sum)
+	dir := filename + blobReferencesSuffix
+	cutoff := time.Now().Add(-blobGracePeriod)
+
+	refs, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+
+	live := 0
+	for _, ref := range refs {
+		if ref.ModTime().After(cutoff) || store.blobReferenceIsLive(sum, ref.Name()) {
+			live++
+			continue
+		}
+		glog.Warningf("Dropping stale reference to blob %s from %s.", sum, ref.Name())
+		os.Remove(filepath.Join(dir, ref.Name()))
+	}
+	if live > 0 {
+		return false, nil
+	}
+
+	// The references go first: a reference made since they were read keeps
+	// them from being removed, and then the blob stays too.
+	if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+		return false, nil
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return false, err
+	}
+	if fi.ModTime().After(cutoff) {
+		return false, nil
+	}
+	return true, os.Remove(filename)
+}
+
+// collectBlobsPeriodically runs CollectBlobs every interval, forever.
+func (store *FilesystemPasteStore) collectBlobsPeriodically(interval time.Duration) {
+	for {
+		n, err := store.CollectBlobs()
+		if err != nil {
+			glog.Error("blob collection failed: ", err)
+		} else if n > 0 {
+			glog.Infof("Collected %d unreferenced blobs.", n)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+)
+
+// BURN_AFTER_READING is the expiration of a paste that's destroyed as soon
+// as somebody other than its creator has read it.
+const BURN_AFTER_READING = "burn"
+
+func (p *Paste) BurnsAfterReading() bool {
+	return p.Expiration == BURN_AFTER_READING
+}
+
+// burnClaims holds the pastes that are being read for the first and last
+// time, so that only one of any number of simultaneous first readers gets to
+// see each.
+var burnClaims = struct {
+	sync.Mutex
+	ids map[PasteID]bool
+}{ids: make(map[PasteID]bool)}
+
+// claimBurn reserves the only reading of the paste with the given ID,
+// returning false if somebody else got there first.
+func claimBurn(id PasteID) bool {
+	burnClaims.Lock()
+	defer burnClaims.Unlock()
+	if burnClaims.ids[id] {
+		return false
+	}
+	burnClaims.ids[id] = true
+	return true
+}
+
+func releaseBurn(id PasteID) {
+	burnClaims.Lock()
+	defer burnClaims.Unlock()
+	delete(burnClaims.ids, id)
+}
+
+// pastesInModel returns every paste that rendering o reveals the contents of.
+func pastesInModel(o Model) []*Paste {
+	switch m := o.(type) {
+	case *Paste:
+		return []*Paste{m}
+	case *PasteRevision:
+		return []*Paste{m.Paste()}
+	case *PasteDiff:
+		if m.Old.Paste.ID == m.New.Paste.ID {
+			return []*Paste{m.Old.Paste}
+		}
+		return []*Paste{m.Old.Paste, m.New.Paste}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+)
+
+// Client-encrypted pastes are encrypted in the browser (or by a CLI) before
+// they're uploaded, with a key that lives only in the paste URL's fragment,
+// which is never sent to us. We store and serve the ciphertext as the paste's
+// body, and never format it; the client decrypts and renders it itself.
+//
+// Method "1" is AES-256-GCM with a random 96-bit IV:
+//
+//	body = base64(iv || ciphertext || tag)
+//
+// where the plaintext is a UTF-8 JSON object of the form
+// {"title": "...", "language": "...", "body": "..."}, so that the paste's title
+// and language are kept from us as well. The key is the raw AES key, encoded
+// as unpadded base64url, following "k=" in the URL fragment.
+const CLIENT_ENCRYPTION_METHOD = "1"
+
+const (
+	clientEncryptionIVSize  = 12
+	clientEncryptionTagSize = 16
+)
+
+type PasteClientEncryptionError string
+
+func (e PasteClientEncryptionError) Error() string {
+	return string(e)
+}
+
+// checkClientEncryption validates a submitted body that claims to have been
+// encrypted by the client with the given method. We can't check that it was,
+// but we can make sure it isn't plaintext posted with the wrong form field.
+func checkClientEncryption(method string, body string, files []*PasteFile) error {
+	if method == "" {
+		return nil
+	}
+
+	if method != CLIENT_ENCRYPTION_METHOD {
+		return PasteClientEncryptionError("I don't know that kind of client-side encryption.")
+	}
+
+	if len(files) > 0 {
+		return PasteClientEncryptionError("Client-encrypted pastes can only have one file.")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(body)
+	if err != nil || len(raw) < clientEncryptionIVSize+clientEncryptionTagSize {
+		return PasteClientEncryptionError("That doesn't look like a client-encrypted paste.")
+	}
+	return nil
+}
+
+// clientCiphertext returns the body of a client-encrypted paste or revision,
+// for the client to decrypt.
+func clientCiphertext(o interface {
+	Reader() (*PasteReader, error)
+}) string {
+	reader, err := o.Reader()
+	if err != nil {
+		return ""
+	}
+	defer reader.Close()
+	b := &bytes.Buffer{}
+	io.Copy(b, reader)
+	return b.String()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Paste bodies can be compressed at rest. The codec a body was written with is
+// recorded in its paste's (or revision's) metadata, so that changing the codec
+// new bodies are written with leaves old ones readable; a body without one was
+// written verbatim.
+//
+// Compression always happens before encryption, as there's nothing to be
+// gained compressing ciphertext: a body is compressed, then encrypted, on its
+// way in, and decrypted, then decompressed, on its way out.
+
+// pasteCompression is the codec new paste bodies are written with, or "" to
+// write them verbatim.
+var pasteCompression string
+
+type compressionCodec struct {
+	newReader func(io.Reader) (io.ReadCloser, error)
+	newWriter func(io.Writer) (io.WriteCloser, error)
+}
+
+var compressionCodecs = map[string]compressionCodec{
+	"gzip": compressionCodec{
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+	},
+	"zstd": compressionCodec{
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			// Without a limit, the decoder keeps goroutines around until it's closed.
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		},
+	},
+}
+
+type PasteCompressionError string
+
+func (e PasteCompressionError) Error() string {
+	return fmt.Sprintf("unknown paste compression %q", string(e))
+}
+
+// parsePasteCompression reads the codec named on the command line; "none"
+// means bodies aren't compressed.
+func parsePasteCompression(s string) (string, error) {
+	if s == "none" || s == "" {
+		return "", nil
+	}
+	if _, ok := compressionCodecs[s]; !ok {
+		return "", PasteCompressionError(s)
+	}
+	return s, nil
+}
+
+// decompressedPasteReader wraps r, a body written with compression, to
+// decompress it.
+func decompressedPasteReader(compression string, r io.ReadCloser) (io.ReadCloser, error) {
+	if compression == "" {
+		return r, nil
+	}
+
+	codec, ok := compressionCodecs[compression]
+	if !ok {
+		r.Close()
+		return nil, PasteCompressionError(compression)
+	}
+
+	dr, err := codec.newReader(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &decompressingReader{ReadCloser: dr, underlying: r}, nil
+}
+
+// decompressingReader closes the body along with the decompressor, which
+// doesn't do it itself.
+type decompressingReader struct {
+	io.ReadCloser
+	underlying io.Closer
+}
+
+func (r *decompressingReader) Close() error {
+	err := r.ReadCloser.Close()
+	if uerr := r.underlying.Close(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// compressedPasteWriter wraps w to compress p's body with the codec new
+// bodies are written with, recording it in p.
+func compressedPasteWriter(p *Paste, w io.WriteCloser) io.WriteCloser {
+	p.compression = pasteCompression
+	if p.compression == "" {
+		return w
+	}
+
+	out := &countingWriter{Writer: w}
+	cw, err := compressionCodecs[p.compression].newWriter(out)
+	if err != nil {
+		// None of the codecs can fail with the options they're given.
+		panic(err)
+	}
+	return &compressingWriter{countingWriter: countingWriter{Writer: cw}, compressor: cw, out: out, underlying: w}
+}
+
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// compressingWriter finishes the compressed stream before closing the body,
+// and then counts how much smaller it came out than what was written.
+type compressingWriter struct {
+	countingWriter
+	compressor io.Closer
+	out        *countingWriter
+	underlying io.Closer
+}
+
+func (w *compressingWriter) Close() error {
+	if err := w.compressor.Close(); err != nil {
+		w.underlying.Close()
+		return err
+	}
+	if err := w.underlying.Close(); err != nil {
+		return err
+	}
+
+	healthServer.AddToMetric("paste.compression.bytes_saved", int(w.n-w.out.n))
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Every edit is made against a version of its paste, named by the paste's
+// ETag: the edit form carries it in its "etag" field, and other clients can
+// send it in If-Match. An edit made against anything but the current version
+// is refused, with a page showing what's changed since and what the edit would
+// change, instead of quietly undoing somebody else's work. Edits that don't
+// say what they were made against are taken as they come.
+
+// PasteConflict is an edit refused because its paste changed underneath it.
+type PasteConflict struct {
+	// Paste is the paste as it is now.
+	Paste *Paste
+	// Theirs is everything changed since the edit was started, if the
+	// revision it was started from can still be found.
+	Theirs *PasteDiff
+	// Yours is what the edit would change now.
+	Yours *PasteDiff
+	// Form is the edit as it was submitted, to be submitted again over the
+	// current version.
+	Form url.Values
+}
+
+// etagMatches reports whether etag is one of those in header, a list of
+// ETags like If-Match's; "*" matches any.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// pasteEditBase returns the ETag the edit in r was made against, or "" if it
+// didn't say.
+func pasteEditBase(r *http.Request) string {
+	if base := r.Header.Get("If-Match"); base != "" {
+		return base
+	}
+	return r.FormValue("etag")
+}
+
+// pasteConflictStatus is what an edit made against an old version is refused
+// with: a client that asked for it in If-Match gets what it asked for, and
+// anybody else gets the conflict.
+func pasteConflictStatus(r *http.Request) int {
+	if r.Header.Get("If-Match") != "" {
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusConflict
+}
+
+// unsavedPasteEdit is what the edit in r would make of p.
+func unsavedPasteEdit(p *Paste, r *http.Request, body string, files []*PasteFile) *UnsavedPasteEdit {
+	edit := &UnsavedPasteEdit{Body: body, Title: r.FormValue("title"), Language: p.Language}
+	if files != nil {
+		edit.Language = files[0].Language
+	} else if r.FormValue("lang") != "" {
+		edit.Language = LanguageNamed(r.FormValue("lang"))
+	}
+	if edit.Language == nil {
+		edit.Language = unknownLanguage
+	}
+	return edit
+}
+
+func NewPasteConflict(p *Paste, base string, edit *UnsavedPasteEdit, form url.Values) *PasteConflict {
+	c := &PasteConflict{Paste: p, Form: url.Values{}}
+	for name, values := range form {
+		if name != "etag" {
+			c.Form[name] = values
+		}
+	}
+
+	if p.ClientEncryption != "" {
+		// Nothing can be compared on the server.
+		return c
+	}
+
+	var err error
+	revs, _ := p.Revisions()
+	for _, rev := range revs {
+		if etagMatches(base, rev.ETag()) {
+			c.Theirs, err = NewPasteDiff(&PasteDiffSide{Paste: p, Revision: rev}, &PasteDiffSide{Paste: p})
+			if err != nil {
+				glog.Errorf("Failed to compare paste %v with revision %d: %v", p.ID, rev.Number, err)
+			}
+			break
+		}
+	}
+
+	c.Yours, err = NewPasteDiff(&PasteDiffSide{Paste: p}, &PasteDiffSide{Paste: p, Unsaved: edit})
+	if err != nil {
+		glog.Errorf("Failed to compare paste %v with an edit to it: %v", p.ID, err)
+	}
+	return c
+}
+
+func renderPasteConflict(c *PasteConflict, status int, w http.ResponseWriter, r *http.Request) {
+	healthServer.IncrementMetric("paste.conflicted")
+	w.Header().Set("ETag", c.Paste.ETag())
+	w.WriteHeader(status)
+	RenderPage(w, r, "paste_conflict", c)
+}
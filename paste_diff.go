@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Diffs between two wildly different inputs are given up on past this many
+// edits; the remainder is shown as wholly removed and wholly added.
+const DIFF_MAX_EDITS int = 1000
+
+// Unchanged lines further than this from a change are collapsed.
+const DIFF_CONTEXT_LINES int = 3
+
+type DiffLineKind string
+
+const (
+	DiffLineUnchanged DiffLineKind = "unchanged"
+	DiffLineDeleted   DiffLineKind = "deleted"
+	DiffLineInserted  DiffLineKind = "inserted"
+	DiffLineSkipped   DiffLineKind = "skipped"
+)
+
+type DiffLine struct {
+	Kind DiffLineKind
+	// OldNumber and NewNumber are 1-based, and 0 on the side a line is absent from.
+	OldNumber, NewNumber int
+	HTML                 template.HTML
+	// Skipped is the number of unchanged lines a DiffLineSkipped line stands in for.
+	Skipped int
+}
+
+// DiffRow is a line of a side-by-side diff. Either side may be nil.
+type DiffRow struct {
+	Old, New *DiffLine
+}
+
+func (r DiffRow) Skipped() bool {
+	return r.Old != nil && r.Old.Kind == DiffLineSkipped
+}
+
+// PasteDiffSide is one side of a diff: a paste, one of its revisions, or an
+// edit to it that hasn't been saved.
+type PasteDiffSide struct {
+	Paste    *Paste
+	Revision *PasteRevision
+	Unsaved  *UnsavedPasteEdit
+}
+
+// UnsavedPasteEdit is the body, title and language an edit would have given a paste.
+type UnsavedPasteEdit struct {
+	Body     string
+	Title    string
+	Language *Language
+}
+
+func (s *PasteDiffSide) Language() *Language {
+	if s.Unsaved != nil {
+		return s.Unsaved.Language
+	}
+	if s.Revision != nil {
+		return s.Revision.Language
+	}
+	return s.Paste.Language
+}
+
+func (s *PasteDiffSide) Title() string {
+	title := s.Paste.Title
+	if s.Unsaved != nil {
+		title = s.Unsaved.Title
+	} else if s.Revision != nil {
+		title = s.Revision.Title
+	}
+	if title == "" {
+		title = "Paste " + s.Paste.ID.String()
+	}
+	if s.Unsaved != nil {
+		title += " (your edit)"
+	} else if s.Revision != nil {
+		title = fmt.Sprintf("%s (revision %d)", title, s.Revision.Number)
+	}
+	return title
+}
+
+func (s *PasteDiffSide) URL() string {
+	if s.Unsaved != nil {
+		return pasteURL("edit", s.Paste)
+	}
+	if s.Revision != nil {
+		return revisionURL("revision", s.Revision)
+	}
+	return pasteURL("show", s.Paste)
+}
+
+func (s *PasteDiffSide) body() (string, error) {
+	if s.Unsaved != nil {
+		return s.Unsaved.Body, nil
+	}
+
+	var reader *PasteReader
+	var err error
+	if s.Revision != nil {
+		reader, err = s.Revision.Reader()
+	} else {
+		reader, err = s.Paste.Reader()
+	}
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	buf, err := ioutil.ReadAll(reader)
+	return string(buf), err
+}
+
+type PasteDiff struct {
+	Old, New   *PasteDiffSide
+	Lines      []*DiffLine
+	Rows       []DiffRow
+	Insertions int
+	Deletions  int
+}
+
+func NewPasteDiff(old, new *PasteDiffSide) (*PasteDiff, error) {
+	oldBody, err := old.body()
+	if err != nil {
+		return nil, err
+	}
+	newBody, err := new.body()
+	if err != nil {
+		return nil, err
+	}
+
+	oldLines, newLines := splitLines(oldBody), splitLines(newBody)
+	oldHTML := formatLines(oldLines, old.Language())
+	newHTML := formatLines(newLines, new.Language())
+
+	d := &PasteDiff{Old: old, New: new}
+	var all []*DiffLine
+	for _, e := range diffLines(oldLines, newLines) {
+		switch e.op {
+		case diffEqual:
+			all = append(all, &DiffLine{Kind: DiffLineUnchanged, OldNumber: e.old + 1, NewNumber: e.new + 1, HTML: newHTML[e.new]})
+		case diffDelete:
+			all = append(all, &DiffLine{Kind: DiffLineDeleted, OldNumber: e.old + 1, HTML: oldHTML[e.old]})
+			d.Deletions++
+		case diffInsert:
+			all = append(all, &DiffLine{Kind: DiffLineInserted, NewNumber: e.new + 1, HTML: newHTML[e.new]})
+			d.Insertions++
+		}
+	}
+
+	d.Lines = collapseUnchangedLines(all)
+	d.Rows = pairDiffLines(d.Lines)
+	return d, nil
+}
+
+func (d *PasteDiff) Identical() bool {
+	return d.Insertions == 0 && d.Deletions == 0
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// formatLines highlights lines as a whole and splits the result back into one
+// fragment per line. Formatters that don't preserve lines (and languages that
+// are displayed as documents, like Markdown) are shown as plain text instead.
+func formatLines(lines []string, language *Language) []template.HTML {
+	out := make([]template.HTML, len(lines))
+	if len(lines) == 0 {
+		return out
+	}
+
+	if language.DisplayStyle == "" {
+		formatted, err := FormatStream(strings.NewReader(strings.Join(lines, "\n")), language)
+		if err != nil {
+			glog.Errorf("Diff render failed: (%s) output: %s", err.Error(), formatted)
+		} else if fragments := splitHTMLLines(formatted); len(fragments) == len(lines) {
+			for i, v := range fragments {
+				out[i] = template.HTML(v)
+			}
+			return out
+		}
+	}
+
+	for i, v := range lines {
+		out[i] = template.HTML(template.HTMLEscapeString(v))
+	}
+	return out
+}
+
+// splitHTMLLines splits formatted HTML at newlines, closing any elements still
+// open at the end of a line and reopening them at the start of the next.
+func splitHTMLLines(s string) []string {
+	var lines []string
+	var open []string
+	var line bytes.Buffer
+	for len(s) > 0 {
+		switch s[0] {
+		case '\n':
+			for i := len(open) - 1; i >= 0; i-- {
+				line.WriteString("</" + tagName(open[i]) + ">")
+			}
+			lines = append(lines, line.String())
+			line.Reset()
+			for _, tag := range open {
+				line.WriteString(tag)
+			}
+			s = s[1:]
+		case '<':
+			end := strings.IndexByte(s, '>')
+			if end == -1 {
+				end = len(s) - 1
+			}
+			tag := s[:end+1]
+			line.WriteString(tag)
+			if strings.HasPrefix(tag, "</") {
+				if len(open) > 0 {
+					open = open[:len(open)-1]
+				}
+			} else if !strings.HasSuffix(tag, "/>") {
+				open = append(open, tag)
+			}
+			s = s[end+1:]
+		default:
+			end := strings.IndexAny(s, "\n<")
+			if end == -1 {
+				end = len(s)
+			}
+			line.WriteString(s[:end])
+			s = s[end:]
+		}
+	}
+	return append(lines, line.String())
+}
+
+func tagName(tag string) string {
+	name := strings.TrimLeft(tag, "<")
+	if end := strings.IndexAny(name, " \t\n/>"); end != -1 {
+		name = name[:end]
+	}
+	return name
+}
+
+// collapseUnchangedLines replaces every run of unchanged lines that's further
+// than DIFF_CONTEXT_LINES from a change with a single DiffLineSkipped line.
+func collapseUnchangedLines(lines []*DiffLine) []*DiffLine {
+	keep := make([]bool, len(lines))
+	for i, l := range lines {
+		if l.Kind == DiffLineUnchanged {
+			continue
+		}
+		for j := i - DIFF_CONTEXT_LINES; j <= i+DIFF_CONTEXT_LINES; j++ {
+			if j >= 0 && j < len(lines) {
+				keep[j] = true
+			}
+		}
+	}
+
+	var out []*DiffLine
+	var skipped *DiffLine
+	for i, l := range lines {
+		if keep[i] {
+			skipped = nil
+			out = append(out, l)
+			continue
+		}
+
+		if skipped == nil {
+			skipped = &DiffLine{Kind: DiffLineSkipped}
+			out = append(out, skipped)
+		}
+		skipped.Skipped++
+	}
+	return out
+}
+
+// pairDiffLines lays lines out side by side, lining up each run of deletions
+// with the insertions that replaced it.
+func pairDiffLines(lines []*DiffLine) []DiffRow {
+	var rows []DiffRow
+	for i := 0; i < len(lines); {
+		l := lines[i]
+		if l.Kind == DiffLineUnchanged || l.Kind == DiffLineSkipped {
+			rows = append(rows, DiffRow{Old: l, New: l})
+			i++
+			continue
+		}
+
+		var deleted, inserted []*DiffLine
+		for ; i < len(lines) && (lines[i].Kind == DiffLineDeleted || lines[i].Kind == DiffLineInserted); i++ {
+			if lines[i].Kind == DiffLineDeleted {
+				deleted = append(deleted, lines[i])
+			} else {
+				inserted = append(inserted, lines[i])
+			}
+		}
+
+		for j := 0; j < len(deleted) || j < len(inserted); j++ {
+			var row DiffRow
+			if j < len(deleted) {
+				row.Old = deleted[j]
+			}
+			if j < len(inserted) {
+				row.New = inserted[j]
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+type diffOp int
+
+const (
+	diffEqual diffOp = iota
+	diffDelete
+	diffInsert
+)
+
+// diffEdit is one step in turning the old lines into the new ones. old and new
+// are indices into each; only the ones that apply to op are meaningful.
+type diffEdit struct {
+	op       diffOp
+	old, new int
+}
+
+// diffLines computes a shortest edit script from a to b, using Myers' O(ND)
+// algorithm on whatever lies between their common prefix and suffix.
+func diffLines(a, b []string) []diffEdit {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	// Compare lines by identity rather than by content from here on.
+	ids := make(map[string]int)
+	intern := func(lines []string) []int {
+		out := make([]int, len(lines))
+		for i, v := range lines {
+			id, ok := ids[v]
+			if !ok {
+				id = len(ids)
+				ids[v] = id
+			}
+			out[i] = id
+		}
+		return out
+	}
+
+	var edits []diffEdit
+	for i := 0; i < prefix; i++ {
+		edits = append(edits, diffEdit{diffEqual, i, i})
+	}
+	for _, e := range myersDiff(intern(a[prefix:len(a)-suffix]), intern(b[prefix:len(b)-suffix])) {
+		edits = append(edits, diffEdit{e.op, e.old + prefix, e.new + prefix})
+	}
+	for i := suffix; i > 0; i-- {
+		edits = append(edits, diffEdit{diffEqual, len(a) - i, len(b) - i})
+	}
+	return edits
+}
+
+func myersDiff(a, b []int) []diffEdit {
+	n, m := len(a), len(b)
+	max := n + m
+	off := max + 1
+	v := make([]int, 2*max+3)
+
+	// trace[d] holds v[-d..d] as it was before step d, for backtracking.
+	var trace [][]int
+	for d := 0; d <= max && d <= DIFF_MAX_EDITS; d++ {
+		snapshot := make([]int, 2*d+1)
+		copy(snapshot, v[off-d:off+d+1])
+		trace = append(trace, snapshot)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+
+			if x >= n && y >= m {
+				return myersBacktrack(trace, n, m)
+			}
+		}
+	}
+
+	edits := make([]diffEdit, 0, n+m)
+	for i := 0; i < n; i++ {
+		edits = append(edits, diffEdit{op: diffDelete, old: i})
+	}
+	for i := 0; i < m; i++ {
+		edits = append(edits, diffEdit{op: diffInsert, new: i})
+	}
+	return edits
+}
+
+func myersBacktrack(trace [][]int, x, y int) []diffEdit {
+	var edits []diffEdit
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[d+k-1] < v[d+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[d+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			edits = append(edits, diffEdit{diffEqual, x, y})
+		}
+
+		if x == prevX {
+			edits = append(edits, diffEdit{op: diffInsert, new: prevY})
+		} else {
+			edits = append(edits, diffEdit{op: diffDelete, old: prevX})
+		}
+		x, y = prevX, prevY
+	}
+
+	for x > 0 && y > 0 {
+		x--
+		y--
+		edits = append(edits, diffEdit{diffEqual, x, y})
+	}
+
+	for i, j := 0, len(edits)-1; i < j; i, j = i+1, j-1 {
+		edits[i], edits[j] = edits[j], edits[i]
+	}
+	return edits
+}
@@ -1,7 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"time"
+
 	"github.com/DHowett/gotimeout"
+	"github.com/golang/glog"
 )
 
 type ExpiringPasteStore struct {
@@ -25,3 +31,239 @@ func (e *ExpiringPasteStore) DestroyExpirable(ex gotimeout.Expirable) {
 func (p *Paste) ExpirationID() gotimeout.ExpirableID {
 	return gotimeout.ExpirableID(p.ID)
 }
+
+type PasteExpirationError string
+
+func (e PasteExpirationError) Error() string {
+	return string(e)
+}
+
+// expirePasteAt records on p that it's to be destroyed at t, or never if t is
+// zero. Deadlines are capped at MAX_EXPIRE_DURATION from now. The expirator
+// isn't told until p has been saved; see scheduleExpiration.
+func expirePasteAt(p *Paste, t time.Time) {
+	if t.IsZero() {
+		p.exptime = t
+		return
+	}
+
+	if latest := time.Now().Add(MAX_EXPIRE_DURATION); t.After(latest) {
+		t = latest
+	}
+	p.exptime = t.UTC().Truncate(time.Second)
+}
+
+// scheduleExpiration brings the expirator in line with the deadline saved on
+// p. It's only called once that deadline has been written, so an edit that
+// fails or loses a conflict doesn't move it.
+func scheduleExpiration(p *Paste) {
+	if p.exptime.IsZero() {
+		if pasteExpirator.ObjectHasExpiration(p) {
+			pasteExpirator.CancelObjectExpiration(p)
+		}
+		return
+	}
+	pasteExpirator.ExpireObject(p, p.exptime.Sub(time.Now()))
+}
+
+// updatePasteExpiration applies the expiration chosen in the paste editor:
+// either expireIn, one of the durations on offer (or "burn", or "-1" for
+// never), or expireAt, an RFC 3339 instant. Saving an existing paste without
+// choosing a new expiration leaves its deadline alone.
+func updatePasteExpiration(p *Paste, expireIn, expireAt string, newPaste bool) error {
+	switch {
+	case expireAt != "":
+		t, err := time.Parse(time.RFC3339, expireAt)
+		if err != nil {
+			return PasteExpirationError("I don't understand when you want that paste to expire.")
+		}
+		if !t.After(time.Now()) {
+			return PasteExpirationError("That paste would have expired before it was saved.")
+		}
+		expireIn = ""
+		expirePasteAt(p, t)
+	case !newPaste && expireIn == p.Expiration:
+	case expireIn == "" || expireIn == "-1" || expireIn == BURN_AFTER_READING:
+		expirePasteAt(p, time.Time{})
+	default:
+		dur, err := ParseDuration(expireIn)
+		if err != nil || dur <= 0 {
+			return PasteExpirationError("I don't understand how long you want that paste to last.")
+		}
+		expirePasteAt(p, time.Now().Add(dur))
+	}
+
+	p.Expiration = expireIn
+	return nil
+}
+
+func (store *FilesystemPasteStore) storeExpiration(p *Paste) error {
+	store.metadataLock.Lock()
+	defer store.metadataLock.Unlock()
+
+	filename := store.filenameForID(p.ID)
+	if _, err := os.Stat(filename); err != nil {
+		return PasteNotFoundError{ID: p.ID}
+	}
+
+	md, err := store.loadMetadata(filename)
+	if err != nil {
+		return err
+	}
+
+	p.storeExpirationMetadata(func(name string, value string) error {
+		md[name] = value
+		return nil
+	})
+	return store.metadata.Store(filename, md)
+}
+
+func (store *SQLitePasteStore) storeExpiration(p *Paste) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = p.storeExpirationMetadata(func(name string, value string) error {
+		_, err := tx.Exec("INSERT OR REPLACE INTO paste_metadata (paste_id, name, value) SELECT id, ?, ? FROM pastes WHERE id = ?", name, value, p.ID.String())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// expiryHandle and expiryFile mirror how gotimeout keeps the expirator's
+// deadlines on disk (it has no way to enumerate them itself.)
+type expiryHandle struct {
+	ID   gotimeout.ExpirableID
+	Time time.Time
+}
+
+func (h *expiryHandle) MarshalBinary() ([]byte, error) {
+	b := &bytes.Buffer{}
+	enc := gob.NewEncoder(b)
+	if err := enc.Encode(string(h.ID)); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(h.Time); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (h *expiryHandle) UnmarshalBinary(b []byte) error {
+	dec := gob.NewDecoder(bytes.NewReader(b))
+	var id string
+	if err := dec.Decode(&id); err != nil {
+		return err
+	}
+	h.ID = gotimeout.ExpirableID(id)
+	return dec.Decode(&h.Time)
+}
+
+type expiryFile map[gotimeout.ExpirableID]*expiryHandle
+
+func (f *expiryFile) MarshalBinary() ([]byte, error) {
+	b := &bytes.Buffer{}
+	if err := gob.NewEncoder(b).Encode(map[gotimeout.ExpirableID]*expiryHandle(*f)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (f *expiryFile) UnmarshalBinary(b []byte) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode((*map[gotimeout.ExpirableID]*expiryHandle)(f))
+}
+
+func loadExpiryFile(path string) (expiryFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return expiryFile{}, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	var f *expiryFile
+	if err := gob.NewDecoder(file).Decode(&f); err != nil || f == nil {
+		// Too old (or too broken) to read; every deadline is in the pastes too.
+		return expiryFile{}, nil
+	}
+	return *f, nil
+}
+
+func (f expiryFile) save(path string) error {
+	asidePath := path + ".atomic"
+	file, err := os.Create(asidePath)
+	if err != nil {
+		return err
+	}
+
+	err = gob.NewEncoder(file).Encode(&f)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(asidePath)
+		return err
+	}
+	return os.Rename(asidePath, path)
+}
+
+// reconcileExpirations makes the expirator's deadlines, in the file at path,
+// agree with the ones recorded with each paste in store. The pastes win, save
+// for those written before deadlines were recorded with them: they take the
+// deadline the expirator had for them, or failing that, the one they used to
+// be shown with. It has to run before the expirator is started, and returns
+// the number of pastes that were due to expire.
+func reconcileExpirations(path string, store PasteStore) (int, error) {
+	old, err := loadExpiryFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	ids, err := store.pasteIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	reconciled := expiryFile{}
+	for _, id := range ids {
+		// Encrypted pastes come back (along with an error) even without their key.
+		p, _ := store.Get(id, nil)
+		if p == nil {
+			continue
+		}
+
+		if p.exptime.IsZero() && p.Expiration != "" && p.Expiration != "-1" && !p.BurnsAfterReading() {
+			if h, ok := old[p.ExpirationID()]; ok {
+				p.exptime = h.Time.UTC().Truncate(time.Second)
+			} else if dur, err := ParseDuration(p.Expiration); err == nil {
+				p.exptime = p.mtime.Add(dur).UTC().Truncate(time.Second)
+			}
+
+			if !p.exptime.IsZero() {
+				if err := store.storeExpiration(p); err != nil {
+					glog.Errorf("Failed to record the expiration of paste %v: %v", p.ID, err)
+				}
+			}
+		}
+
+		if !p.exptime.IsZero() {
+			reconciled[p.ExpirationID()] = &expiryHandle{ID: p.ExpirationID(), Time: p.exptime}
+		}
+	}
+
+	for id := range old {
+		if _, ok := reconciled[id]; !ok {
+			glog.Info("Paste ", id, " no longer expires; forgetting its expiration.")
+		}
+	}
+
+	return len(reconciled), reconciled.save(path)
+}
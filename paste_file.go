@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// PasteFile is one named file in a multi-file paste. A multi-file paste's body
+// is the contents of all of its files, one after another; each file's Length
+// locates it in the body. Single-file pastes have no PasteFiles.
+type PasteFile struct {
+	Name     string    `json:"name"`
+	Language *Language `json:"language"`
+	Length   int64     `json:"length"`
+}
+
+type PasteFileNotFoundError struct {
+	ID   PasteID
+	Name string
+}
+
+func (e PasteFileNotFoundError) Error() string {
+	return fmt.Sprintf("Paste %v has no file named %s.", e.ID, e.Name)
+}
+
+type pasteFileMetadata struct {
+	Name     string `json:"name"`
+	Language string `json:"language"`
+	Length   int64  `json:"length"`
+}
+
+func encodePasteFiles(files []*PasteFile) string {
+	if len(files) == 0 {
+		return ""
+	}
+
+	md := make([]pasteFileMetadata, len(files))
+	for i, f := range files {
+		md[i] = pasteFileMetadata{Name: f.Name, Language: f.Language.ID, Length: f.Length}
+	}
+
+	buf, _ := json.Marshal(md)
+	return string(buf)
+}
+
+func decodePasteFiles(s string) ([]*PasteFile, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var md []pasteFileMetadata
+	if err := json.Unmarshal([]byte(s), &md); err != nil {
+		return nil, err
+	}
+
+	files := make([]*PasteFile, len(md))
+	for i, f := range md {
+		files[i] = &PasteFile{Name: f.Name, Language: LanguageNamed(f.Language), Length: f.Length}
+	}
+	return files, nil
+}
+
+// fileNamed returns the index of the named file in files.
+func fileNamed(files []*PasteFile, name string) (int, bool) {
+	for i, f := range files {
+		if f.Name == name {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// fileReader narrows a reader over a whole multi-file body down to files[i].
+func fileReader(reader *PasteReader, files []*PasteFile, i int) (*PasteReader, error) {
+	var offset int64
+	for _, f := range files[:i] {
+		offset += f.Length
+	}
+
+	if _, err := io.CopyN(ioutil.Discard, reader, offset); err != nil {
+		reader.Close()
+		return nil, err
+	}
+
+	return &PasteReader{ReadCloser: &ReadCloser{Reader: io.LimitReader(reader, files[i].Length), Closer: reader}, paste: reader.paste}, nil
+}
+
+func (p *Paste) FileReader(i int) (*PasteReader, error) {
+	reader, err := p.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return fileReader(reader, p.Files, i)
+}
+
+func (r *PasteRevision) FileReader(i int) (*PasteReader, error) {
+	reader, err := r.Reader()
+	if err != nil {
+		return nil, err
+	}
+	return fileReader(reader, r.Files, i)
+}
+
+// pasteFileName cleans up a submitted file name, making one up from the
+// file's position and language if there isn't one, and making it unique among
+// taken.
+func pasteFileName(name string, i int, language *Language, taken map[string]bool) string {
+	name = cleanFileName(name)
+	if name == "" {
+		ext := "txt"
+		if len(language.Extensions) > 0 {
+			ext = language.Extensions[0]
+		}
+		name = fmt.Sprintf("file%d.%s", i+1, ext)
+	}
+	return uniqueFileName(name, taken)
+}
+
+// cleanFileName strips anything resembling a path out of a submitted file
+// name, leaving nothing at all if there's nothing else to it.
+func cleanFileName(name string) string {
+	name = strings.TrimSpace(strings.NewReplacer("/", "_", "\\", "_").Replace(name))
+	if name == "." || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// uniqueFileName numbers name, if need be, so that it isn't among taken, and
+// then adds it to them.
+func uniqueFileName(name string, taken map[string]bool) string {
+	unique := name
+	for n := 2; taken[unique]; n++ {
+		unique = fmt.Sprintf("%s (%d)", name, n)
+	}
+	taken[unique] = true
+	return unique
+}
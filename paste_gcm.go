@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Encryption method 3 seals the body in chunks of AES-GCM, using a scheme
+// along the lines of the STREAM construction: a random prefix, written at the
+// start of the body, is combined with each chunk's index and a flag marking
+// the last chunk to form that chunk's nonce. Every chunk is authenticated
+// against the paste's ID, so chunks can't be reordered, dropped, truncated or
+// moved between pastes without the read failing.
+const (
+	gcmChunkSize   = 64 * 1024
+	gcmPrefixSize  = 7
+	gcmChunkLabel  = "paste body"
+	gcmFinalChunk  = 1
+	gcmMiddleChunk = 0
+)
+
+var errGCMBodyTampered = errors.New("encrypted paste body failed authentication")
+
+// gcmForPaste derives the body key from the paste's key, so that the key used
+// for the paste's hmac never encrypts anything itself.
+func gcmForPaste(p *Paste) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(constructMAC([]byte(gcmChunkLabel), p.encryptionKey))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func gcmNonce(prefix []byte, index uint32, final byte) []byte {
+	nonce := make([]byte, gcmPrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[gcmPrefixSize:], index)
+	nonce[gcmPrefixSize+4] = final
+	return nonce
+}
+
+type gcmChunkWriter struct {
+	w      io.WriteCloser
+	aead   cipher.AEAD
+	ad     []byte
+	prefix []byte
+	index  uint32
+	buf    []byte
+	err    error
+}
+
+func newGCMChunkWriter(p *Paste, w io.WriteCloser) io.WriteCloser {
+	return newGCMChunkWriterWithData(p, []byte(p.ID.String()), w)
+}
+
+// newGCMChunkWriterWithData seals w under p's key, authenticating it against
+// ad instead of p's ID, for things other than p's body.
+func newGCMChunkWriterWithData(p *Paste, ad []byte, w io.WriteCloser) io.WriteCloser {
+	cw := &gcmChunkWriter{w: w, ad: ad, buf: make([]byte, 0, gcmChunkSize)}
+	cw.aead, cw.err = gcmForPaste(p)
+	if cw.err == nil {
+		cw.prefix, cw.err = generateRandomBytes(gcmPrefixSize)
+	}
+	if cw.err == nil {
+		_, cw.err = w.Write(cw.prefix)
+	}
+	return cw
+}
+
+func (cw *gcmChunkWriter) seal(final byte) {
+	sealed := cw.aead.Seal(nil, gcmNonce(cw.prefix, cw.index, final), cw.buf, cw.ad)
+	_, cw.err = cw.w.Write(sealed)
+	cw.buf = cw.buf[:0]
+	cw.index++
+}
+
+func (cw *gcmChunkWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 && cw.err == nil {
+		// A full chunk is only sealed once there's more to come; the last
+		// chunk has to be sealed as such on Close.
+		if len(cw.buf) == gcmChunkSize {
+			cw.seal(gcmMiddleChunk)
+			continue
+		}
+
+		c := copy(cw.buf[len(cw.buf):gcmChunkSize], b)
+		cw.buf = cw.buf[:len(cw.buf)+c]
+		b = b[c:]
+		n += c
+	}
+	return n, cw.err
+}
+
+func (cw *gcmChunkWriter) Close() error {
+	if cw.err == nil {
+		cw.seal(gcmFinalChunk)
+	}
+	if err := cw.w.Close(); cw.err == nil {
+		cw.err = err
+	}
+	return cw.err
+}
+
+type gcmChunkReader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	ad     []byte
+	prefix []byte
+	index  uint32
+	sealed []byte
+	buf    []byte
+	final  bool
+	err    error
+}
+
+func newGCMChunkReader(p *Paste, r io.ReadCloser) io.ReadCloser {
+	return newGCMChunkReaderWithData(p, []byte(p.ID.String()), r)
+}
+
+func newGCMChunkReaderWithData(p *Paste, ad []byte, r io.ReadCloser) io.ReadCloser {
+	cr := &gcmChunkReader{r: bufio.NewReader(r), ad: ad}
+	cr.aead, cr.err = gcmForPaste(p)
+	if cr.err == nil {
+		cr.prefix = make([]byte, gcmPrefixSize)
+		if _, err := io.ReadFull(cr.r, cr.prefix); err != nil {
+			cr.err = errGCMBodyTampered
+		}
+	}
+	if cr.err == nil {
+		cr.sealed = make([]byte, gcmChunkSize+cr.aead.Overhead())
+	}
+	return &ReadCloser{Reader: cr, Closer: r}
+}
+
+func (cr *gcmChunkReader) open() {
+	n, err := io.ReadFull(cr.r, cr.sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		cr.err = errGCMBodyTampered
+		return
+	}
+
+	// The last chunk is the one with nothing after it.
+	final := byte(gcmMiddleChunk)
+	if _, err := cr.r.Peek(1); err == io.EOF {
+		final = gcmFinalChunk
+	}
+
+	cr.buf, err = cr.aead.Open(cr.sealed[:0], gcmNonce(cr.prefix, cr.index, final), cr.sealed[:n], cr.ad)
+	if err != nil {
+		cr.err = errGCMBodyTampered
+		return
+	}
+	cr.index++
+	cr.final = final == gcmFinalChunk
+}
+
+func (cr *gcmChunkReader) Read(b []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.err != nil {
+			return 0, cr.err
+		}
+		if cr.final {
+			return 0, io.EOF
+		}
+		cr.open()
+	}
+
+	n := copy(b, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+)
+
+type FilesystemLayout string
+
+const (
+	// FilesystemLayoutFlat keeps every paste directly in the paste directory.
+	FilesystemLayoutFlat FilesystemLayout = "flat"
+	// FilesystemLayoutSharded spreads pastes out over two levels of
+	// subdirectories named for the start of their IDs: abcdefgh lives at ab/cd/abcdefgh.
+	FilesystemLayoutSharded FilesystemLayout = "sharded"
+)
+
+// shardLength is how many characters of an ID name each level of shard directories.
+const shardLength = 2
+
+func (l FilesystemLayout) other() FilesystemLayout {
+	if l == FilesystemLayoutFlat {
+		return FilesystemLayoutSharded
+	}
+	return FilesystemLayoutFlat
+}
+
+// isShardName reports whether name could be a shard directory; paste IDs are
+// always longer than one.
+func isShardName(name string) bool {
+	return len(name) == shardLength && filepath.Ext(name) == ""
+}
+
+// detectLayout works out the layout the store in dir is already kept in: sharded
+// if it has any shard directories, flat if it only has pastes kept directly in
+// it, and sharded for a store that's still empty.
+func detectLayout(dir string) FilesystemLayout {
+	ids, shards, err := pasteIDsInDirectory(dir)
+	if err != nil {
+		glog.Errorf("Failed to look for pastes in %s: %v", dir, err)
+	}
+	if len(ids) > 0 && len(shards) == 0 {
+		return FilesystemLayoutFlat
+	}
+	return FilesystemLayoutSharded
+}
+
+// layoutFilenameForID is where id's paste file goes in layout. IDs too short
+// to be sharded are always kept flat.
+func (store *FilesystemPasteStore) layoutFilenameForID(layout FilesystemLayout, id PasteID) string {
+	s := id.String()
+	if layout == FilesystemLayoutFlat || len(s) <= 2*shardLength {
+		return filepath.Join(store.path, s)
+	}
+	return filepath.Join(store.path, s[:shardLength], s[shardLength:2*shardLength], s)
+}
+
+// locate finds the file (or directory) belonging to id with the given suffix,
+// in whichever layout it's in. One that doesn't exist yet belongs in the
+// store's own layout.
+//
+// Each of a paste's files is looked for on its own, so that a paste can be
+// read while it's being moved from one layout to the other.
+func (store *FilesystemPasteStore) locate(id PasteID, suffix string) string {
+	filename := store.layoutFilenameForID(store.layout, id) + suffix
+	if _, err := os.Lstat(filename); os.IsNotExist(err) {
+		other := store.layoutFilenameForID(store.layout.other(), id) + suffix
+		if _, err := os.Lstat(other); err == nil {
+			return other
+		}
+	}
+	return filename
+}
+
+// ConvertLayout moves every paste still in the other layout into the one this
+// store is using. Until a paste is moved, it's found where it was, so this is
+// safe to run while the store is in use.
+func (store *FilesystemPasteStore) ConvertLayout() (int, error) {
+	ids, err := store.pasteIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, id := range ids {
+		moved, err := store.convertLayoutForID(id)
+		if err != nil {
+			glog.Errorf("Failed to move paste %v: %v", id, err)
+		}
+		if moved {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (store *FilesystemPasteStore) convertLayoutForID(id PasteID) (bool, error) {
+	// Nothing else rewrites the paste's metadata while it's on the move.
+	store.metadataLock.Lock()
+	defer store.metadataLock.Unlock()
+
+	from := store.filenameForID(id)
+	to := store.layoutFilenameForID(store.layout, id)
+	if from == to {
+		return false, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(to), 0700); err != nil {
+		return false, err
+	}
+
+	// A sidecar has to be beside the paste file wherever it's found, so it's
+	// linked into place before the paste moves and unlinked after.
+	sidecar := false
+	if err := os.Link(from+sidecarMetadataSuffix, to+sidecarMetadataSuffix); err == nil {
+		sidecar = true
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	if err := os.Rename(from, to); err != nil {
+		if sidecar {
+			os.Remove(to + sidecarMetadataSuffix)
+		}
+		return false, err
+	}
+	if sidecar {
+		os.Remove(from + sidecarMetadataSuffix)
+	}
+
+	for _, suffix := range []string{".revs", ".attachments"} {
+		err := os.Rename(from+suffix, to+suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return true, err
+		}
+	}
+
+	// Shard directories that are left empty are tidied away; anything else
+	// is left alone.
+	if dir := filepath.Dir(from); dir != store.path {
+		if os.Remove(dir) == nil {
+			os.Remove(filepath.Dir(dir))
+		}
+	}
+	return true, nil
+}
+
+// pasteIDsInDirectory lists the pastes directly in dir.
+func pasteIDsInDirectory(dir string) ([]PasteID, []os.FileInfo, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	fis, err := f.Readdir(-1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ids := make([]PasteID, 0, len(fis))
+	var shards []os.FileInfo
+	for _, fi := range fis {
+		if fi.IsDir() && isShardName(fi.Name()) {
+			shards = append(shards, fi)
+			continue
+		}
+
+		// Paste IDs never contain dots; anything with one is ours (sidecars, probes, &c.)
+		if !fi.Mode().IsRegular() || filepath.Ext(fi.Name()) != "" {
+			continue
+		}
+		ids = append(ids, PasteIDFromString(fi.Name()))
+	}
+	return ids, shards, nil
+}
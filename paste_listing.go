@@ -0,0 +1,155 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// The listing index remembers which pastes are public and which account owns
+// each, so that the public listing and an account's pastes can be shown
+// without reading the metadata of every paste in the store. It's filled from
+// the store the first time it's needed, and kept up to date by the store's
+// callbacks from then on.
+
+type pasteListingEntry struct {
+	public   bool
+	owner    string
+	modified time.Time
+}
+
+type PasteListing struct {
+	mu      sync.RWMutex
+	entries map[PasteID]pasteListingEntry
+	loaded  bool
+	// seen holds the pastes the callbacks have told us about while the
+	// listing was being loaded, so that the load doesn't undo what they did.
+	seen map[PasteID]bool
+
+	loadMu sync.Mutex
+}
+
+var pasteListing = &PasteListing{
+	entries: make(map[PasteID]pasteListingEntry),
+	seen:    make(map[PasteID]bool),
+}
+
+// set records p, or forgets it if it's neither public nor owned. The caller
+// holds mu.
+func (l *PasteListing) set(p *Paste) {
+	if !p.IsPublic() && p.Owner == "" {
+		delete(l.entries, p.ID)
+		return
+	}
+	l.entries[p.ID] = pasteListingEntry{public: p.IsPublic(), owner: p.Owner, modified: p.LastModified()}
+}
+
+// Update records p, which has just been saved.
+func (l *PasteListing) Update(p *Paste) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.set(p)
+	if !l.loaded {
+		l.seen[p.ID] = true
+	}
+}
+
+func (l *PasteListing) Remove(p *Paste) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, p.ID)
+	if !l.loaded {
+		l.seen[p.ID] = true
+	}
+}
+
+// load fills the listing from the store, unless it already has been. It
+// doesn't hold mu while it reads the store, as the store may call back while
+// holding locks of its own that loading a paste needs.
+func (l *PasteListing) load() {
+	l.loadMu.Lock()
+	defer l.loadMu.Unlock()
+
+	l.mu.RLock()
+	loaded := l.loaded
+	l.mu.RUnlock()
+	if loaded {
+		return
+	}
+
+	ids, err := pasteStore.pasteIDs()
+	if err != nil {
+		glog.Errorln("Failed to list pastes:", err)
+		return
+	}
+
+	pastes := make([]*Paste, 0, len(ids))
+	for _, id := range ids {
+		// Encrypted pastes come back (along with an error) even without their key.
+		if p, _ := pasteStore.Get(id, nil); p != nil {
+			pastes = append(pastes, p)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, p := range pastes {
+		if !l.seen[p.ID] {
+			l.set(p)
+		}
+	}
+	l.loaded, l.seen = true, nil
+	glog.Infof("Listed %d public or owned pastes.", len(l.entries))
+}
+
+// pastes returns the listed pastes that match, newest first; at most limit
+// of them, if limit is positive. Encrypted pastes are returned without their
+// keys.
+func (l *PasteListing) pastes(match func(pasteListingEntry) bool, limit int) []*Paste {
+	l.load()
+
+	type listed struct {
+		id       PasteID
+		modified time.Time
+	}
+	var matched []listed
+	l.mu.RLock()
+	for id, e := range l.entries {
+		if match(e) {
+			matched = append(matched, listed{id, e.modified})
+		}
+	}
+	l.mu.RUnlock()
+
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].modified.After(matched[j].modified)
+	})
+
+	pastes := make([]*Paste, 0, len(matched))
+	for _, m := range matched {
+		if limit > 0 && len(pastes) == limit {
+			break
+		}
+		if p, _ := pasteStore.Get(m.id, nil); p != nil {
+			pastes = append(pastes, p)
+		}
+	}
+	return pastes
+}
+
+// Public returns the public pastes, newest first; at most limit of them, if
+// limit is positive.
+func (l *PasteListing) Public(limit int) []*Paste {
+	return l.pastes(func(e pasteListingEntry) bool {
+		return e.public
+	}, limit)
+}
+
+// Owned returns every paste owned by owner, newest first.
+func (l *PasteListing) Owned(owner string) []*Paste {
+	return l.pastes(func(e pasteListingEntry) bool {
+		return e.owner == owner
+	}, 0)
+}
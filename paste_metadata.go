@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/DHowett/go-xattr"
+	"github.com/golang/glog"
+)
+
+type FilesystemMetadataMode string
+
+const (
+	// FilesystemMetadataAuto uses extended attributes when the paste directory supports them.
+	FilesystemMetadataAuto FilesystemMetadataMode = "auto"
+	// FilesystemMetadataXattr stores metadata in user.paste.* extended attributes on the paste file.
+	FilesystemMetadataXattr FilesystemMetadataMode = "xattr"
+	// FilesystemMetadataSidecar stores metadata in a JSON file next to the paste file.
+	FilesystemMetadataSidecar FilesystemMetadataMode = "sidecar"
+)
+
+const sidecarMetadataSuffix = ".meta"
+
+// metadataBackend persists the metadata for a paste stored at filename.
+type metadataBackend interface {
+	Load(filename string) (map[string]string, error)
+	Store(filename string, md map[string]string) error
+	Remove(filename string) error
+}
+
+type xattrMetadataBackend struct{}
+
+func (xattrMetadataBackend) Load(filename string) (map[string]string, error) {
+	md := make(map[string]string)
+	for _, name := range pasteMetadataNames {
+		value, err := xattr.Getxattr(filename, "user.paste."+name, 0, 0)
+		if err != nil || len(value) == 0 {
+			continue
+		}
+		md[name] = string(value)
+	}
+	return md, nil
+}
+
+func (xattrMetadataBackend) Store(filename string, md map[string]string) error {
+	for name, value := range md {
+		if err := xattr.Setxattr(filename, "user.paste."+name, []byte(value), 0, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove blanks out every attribute, as go-xattr can't remove them. Load
+// treats a blank attribute as a missing one.
+func (xattrMetadataBackend) Remove(filename string) error {
+	for _, name := range pasteMetadataNames {
+		xattr.Setxattr(filename, "user.paste."+name, []byte{}, 0, 0)
+	}
+	return nil
+}
+
+// sidecarMetadataBackend keeps metadata in a JSON object in filename.meta,
+// for filesystems (tmpfs, some overlay and NFS mounts) without xattr support.
+type sidecarMetadataBackend struct{}
+
+func (sidecarMetadataBackend) Load(filename string) (map[string]string, error) {
+	md := make(map[string]string)
+	buf, err := ioutil.ReadFile(filename + sidecarMetadataSuffix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return md, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, &md); err != nil {
+		return nil, err
+	}
+	return md, nil
+}
+
+// Store merges md into the existing sidecar, mirroring how setting one
+// extended attribute leaves the others alone.
+func (s sidecarMetadataBackend) Store(filename string, md map[string]string) error {
+	existing, err := s.Load(filename)
+	if err != nil {
+		return err
+	}
+
+	for name, value := range md {
+		existing[name] = value
+	}
+
+	buf, err := json.Marshal(existing)
+	if err != nil {
+		return err
+	}
+
+	asideFilename := filename + sidecarMetadataSuffix + ".atomic"
+	if err := ioutil.WriteFile(asideFilename, buf, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(asideFilename, filename+sidecarMetadataSuffix)
+}
+
+func (sidecarMetadataBackend) Remove(filename string) error {
+	err := os.Remove(filename + sidecarMetadataSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// directorySupportsXattrs probes dir by setting an extended attribute on a scratch file.
+func directorySupportsXattrs(dir string) bool {
+	f, err := ioutil.TempFile(dir, ".xattr-probe")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	return xattr.Setxattr(f.Name(), "user.paste.probe", []byte("1"), 0, 0) == nil
+}
+
+func newMetadataBackends(dir string, mode FilesystemMetadataMode) (primary, secondary metadataBackend) {
+	if mode == FilesystemMetadataAuto {
+		mode = FilesystemMetadataXattr
+		if !directorySupportsXattrs(dir) {
+			glog.Warning(dir, " does not support extended attributes; falling back to sidecar metadata.")
+			mode = FilesystemMetadataSidecar
+		}
+	}
+
+	if mode == FilesystemMetadataSidecar {
+		return sidecarMetadataBackend{}, xattrMetadataBackend{}
+	}
+	return xattrMetadataBackend{}, sidecarMetadataBackend{}
+}
+
+// ConvertMetadata moves the metadata of every paste (and its revisions and
+// attachments) still in the other layout into the one this store is using.
+// Until a paste is converted, reads fall back to the other layout, so this is
+// safe to run while the store is in use.
+func (store *FilesystemPasteStore) ConvertMetadata() (int, error) {
+	ids, err := store.pasteIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, id := range ids {
+		filenames := []string{store.filenameForID(id)}
+		numbers, _ := store.revisionNumbers(id)
+		for _, rev := range numbers {
+			filenames = append(filenames, filepath.Join(store.revisionDirectoryForID(id), strconv.Itoa(rev)))
+		}
+		attachments, _ := store.Attachments(&Paste{ID: id, store: store})
+		for _, a := range attachments {
+			filenames = append(filenames, store.attachmentFilename(a))
+		}
+
+		converted := false
+		for _, filename := range filenames {
+			ok, err := store.convertMetadataForFile(filename)
+			if err != nil {
+				glog.Errorf("Failed to convert metadata for paste %v: %v", id, err)
+			}
+			converted = converted || ok
+		}
+
+		if converted {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (store *FilesystemPasteStore) convertMetadataForFile(filename string) (bool, error) {
+	// Nothing else rewrites the file's metadata while it's on the move.
+	store.metadataLock.Lock()
+	defer store.metadataLock.Unlock()
+
+	md, err := store.metadata.Load(filename)
+	if err != nil || len(md) > 0 {
+		return false, err
+	}
+
+	md, err = store.legacyMetadata.Load(filename)
+	if err != nil || len(md) == 0 {
+		return false, nil
+	}
+
+	if err := store.metadata.Store(filename, md); err != nil {
+		return false, err
+	}
+
+	store.legacyMetadata.Remove(filename)
+	return true, nil
+}
+
+// pasteIDs lists the IDs of every paste in the store, in either layout.
+func (store *FilesystemPasteStore) pasteIDs() ([]PasteID, error) {
+	ids, shards, err := pasteIDsInDirectory(store.path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, shard := range shards {
+		_, subshards, err := pasteIDsInDirectory(filepath.Join(store.path, shard.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, subshard := range subshards {
+			found, _, err := pasteIDsInDirectory(filepath.Join(store.path, shard.Name(), subshard.Name()))
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, found...)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Pastes created by somebody who's signed in record their account as their
+// owner. Unlike the permissions in a session, which go wherever the session's
+// cookie goes, the owner stays with the paste: the account can always edit
+// it, and can list it among its pastes from anywhere.
+
+// requestOwner is the owner to record for a paste created by r; nobody, if
+// r isn't signed in.
+func requestOwner(r *http.Request) string {
+	if user := GetUser(r); user != nil {
+		return user.Name
+	}
+	return ""
+}
+
+// isPasteOwner reports whether r is signed in to the account that owns p.
+func isPasteOwner(p *Paste, r *http.Request) bool {
+	return p.Owner != "" && p.Owner == requestOwner(r)
+}
+
+// ownedPastes returns every paste owned by owner, newest first.
+func ownedPastes(owner string) []*Paste {
+	return pasteListing.Owned(owner)
+}
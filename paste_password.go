@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PastePasswordError is a password change that can't be made.
+type PastePasswordError string
+
+func (e PastePasswordError) Error() string {
+	return string(e)
+}
+
+// ChangeEncryptionKey re-encrypts p's body, along with every one of its
+// revisions and attachments, under key and salt. A nil key removes p's encryption entirely.
+// Nothing is written until everything has been read with the old key.
+func (p *Paste) ChangeEncryptionKey(key, salt []byte) error {
+	return p.store.reencrypt(p, key, salt)
+}
+
+// changeEncryptionKey switches p over to key and salt in memory only.
+func (p *Paste) changeEncryptionKey(key, salt []byte) {
+	p.SetEncryptionKey(key)
+	p.encryptionSalt = nil
+	p.encryptionMethod = ""
+	if p.Encrypted {
+		p.encryptionSalt = salt
+		p.encryptionMethod = CURRENT_ENCRYPTION_METHOD
+	}
+}
+
+// decryptedPasteBodies reads the bodies of p and all of its revisions in the
+// clear, so that they can be written back under a new key.
+func decryptedPasteBodies(p *Paste) (body []byte, revs []*PasteRevision, revBodies [][]byte, err error) {
+	revs, err = p.Revisions()
+	if err != nil {
+		return
+	}
+
+	revBodies = make([][]byte, len(revs))
+	for i, rev := range revs {
+		if revBodies[i], err = readPasteBody(rev.Reader()); err != nil {
+			return
+		}
+	}
+
+	body, err = readPasteBody(p.Reader())
+	return
+}
+
+func readPasteBody(reader *PasteReader, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// encryptPasteBody returns body as p's store would write it, compressed as
+// new bodies are.
+func encryptPasteBody(p *Paste, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := compressedPasteWriter(p, encryptedPasteWriter(p, nopWriteCloser{&buf}))
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeReplacementFile writes sealed, a body already encrypted for its paste,
+// and md beside filename, backdated to mtime so that re-encrypting a paste
+// doesn't look like an edit (or put off its expiry.) It returns the name of
+// the new file, which replaceFile moves into place.
+func (store *FilesystemPasteStore) writeReplacementFile(filename string, sealed []byte, md map[string]string, mtime time.Time) (string, error) {
+	dst, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = dst.Write(sealed)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = store.metadata.Store(dst.Name(), md)
+	}
+	if err == nil {
+		err = os.Chtimes(dst.Name(), mtime, mtime)
+	}
+	if err != nil {
+		store.removeReplacementFile(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
+
+// removeReplacementFile removes the sidecar first: left alone, it would look
+// like the metadata of a body that had been committed.
+func (store *FilesystemPasteStore) removeReplacementFile(name string) {
+	sidecarMetadataBackend{}.Remove(name)
+	os.Remove(name)
+}
+
+// replaceFile moves a file written by writeReplacementFile (or a
+// filesystemPasteBodyWriter), and its sidecar if it has one, over filename.
+func (store *FilesystemPasteStore) replaceFile(name, filename string) error {
+	if err := os.Rename(name, filename); err != nil {
+		return err
+	}
+
+	if _, ok := store.metadata.(sidecarMetadataBackend); ok {
+		// A brand new paste doesn't have any metadata yet.
+		err := os.Rename(name+sidecarMetadataSuffix, filename+sidecarMetadataSuffix)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// reencryptionJournalSuffix names the file, beside a paste, that lists the
+// replacements a password change has yet to move into place.
+const reencryptionJournalSuffix = ".reencrypt"
+
+// writeReencryptionJournal records that each of replacements is to be moved
+// over the filename beside it. Once it's written, the password change has as
+// good as been made: if the server stops before it's finished,
+// RecoverInterruptedWrites finishes it.
+func (store *FilesystemPasteStore) writeReencryptionJournal(journal string, replacements, filenames []string) error {
+	var buf bytes.Buffer
+	for i := range replacements {
+		name, err := filepath.Rel(store.path, replacements[i])
+		if err != nil {
+			return err
+		}
+		filename, err := filepath.Rel(store.path, filenames[i])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&buf, "%s\t%s\n", name, filename)
+	}
+
+	asideFilename := journal + ".atomic"
+	if err := ioutil.WriteFile(asideFilename, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(asideFilename, journal)
+}
+
+// finishReencryption moves every replacement journal lists into place, then
+// removes it. Replacements that have already been moved are skipped.
+func (store *FilesystemPasteStore) finishReencryption(journal string) error {
+	buf, err := ioutil.ReadFile(journal)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(string(buf)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
+			return fmt.Errorf("%s is malformed", journal)
+		}
+
+		name, filename := filepath.Join(store.path, fields[0]), filepath.Join(store.path, fields[1])
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			// Moved already, but maybe not its sidecar.
+			err := os.Rename(name+sidecarMetadataSuffix, filename+sidecarMetadataSuffix)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		if err := store.replaceFile(name, filename); err != nil {
+			return err
+		}
+	}
+	return os.Remove(journal)
+}
+
+func (store *FilesystemPasteStore) reencrypt(p *Paste, key, salt []byte) error {
+	store.metadataLock.Lock()
+	defer store.metadataLock.Unlock()
+
+	// Nothing else can replace the paste file while we hold the lock, so
+	// it's checked only the once.
+	filename := store.filenameForID(p.ID)
+	md, err := store.loadMetadata(filename)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	if pasteETag(md["version"], fi.ModTime()) != p.ETag() {
+		return PasteModifiedError{ID: p.ID}
+	}
+
+	body, revs, revBodies, err := decryptedPasteBodies(p)
+	if err != nil {
+		return err
+	}
+
+	attachments, attachmentBodies, err := decryptedAttachments(p)
+	if err != nil {
+		return err
+	}
+
+	// Bodies are always rewritten in full, even ones that had been
+	// deduplicated; the blobs they were in are let go once they're in place.
+	refs := store.blobReferences(p.ID)
+	p.blob = ""
+
+	p.changeEncryptionKey(key, salt)
+	if err := p.newVersion(); err != nil {
+		return err
+	}
+
+	// Every replacement is written, and then listed in a journal beside the
+	// paste, before any of them are moved into place; that way, the paste
+	// and its revisions are never left disagreeing about their key.
+	var filenames, replacements []string
+	defer func() {
+		for _, name := range replacements {
+			store.removeReplacementFile(name)
+		}
+	}()
+
+	for i, rev := range revs {
+		filename := filepath.Join(store.revisionDirectoryForID(p.ID), strconv.Itoa(rev.Number))
+		md, err := store.loadMetadata(filename)
+		if err != nil {
+			return err
+		}
+		sealed, err := encryptPasteBody(p, revBodies[i])
+		if err != nil {
+			return err
+		}
+		md["encryption_version"] = p.encryptionMethod
+		md["compression"] = p.compression
+		md["blob"] = ""
+
+		name, err := store.writeReplacementFile(filename, sealed, md, rev.mtime)
+		if err != nil {
+			return err
+		}
+		filenames, replacements = append(filenames, filename), append(replacements, name)
+	}
+
+	for i, a := range attachments {
+		sealed, err := encryptAttachmentBody(a, attachmentBodies[i])
+		if err != nil {
+			return err
+		}
+
+		filename := store.attachmentFilename(a)
+		name, err := store.writeReplacementFile(filename, sealed, a.metadata(), a.mtime)
+		if err != nil {
+			return err
+		}
+		filenames, replacements = append(filenames, filename), append(replacements, name)
+	}
+
+	sealed, err := encryptPasteBody(p, body)
+	if err != nil {
+		return err
+	}
+
+	// Only how the body is stored changes; the rest of the metadata is kept
+	// as it is on disk, so as not to undo anything saved since p was loaded.
+	p.storeBodyMetadata(func(name string, value string) error {
+		md[name] = value
+		return nil
+	})
+
+	name, err := store.writeReplacementFile(filename, sealed, md, p.mtime)
+	if err != nil {
+		return err
+	}
+	filenames, replacements = append(filenames, filename), append(replacements, name)
+
+	journal := filename + reencryptionJournalSuffix
+	if err := store.writeReencryptionJournal(journal, replacements, filenames); err != nil {
+		return err
+	}
+	// The replacements are the journal's now; should moving them fail, they
+	// are moved when the server next starts.
+	replacements = nil
+	if err := store.finishReencryption(journal); err != nil {
+		return err
+	}
+	store.releaseBlobReferences(refs)
+
+	store.PasteUpdateCallback(p)
+	return nil
+}
+
+func (store *SQLitePasteStore) reencrypt(p *Paste, key, salt []byte) error {
+	body, revs, revBodies, err := decryptedPasteBodies(p)
+	if err != nil {
+		return err
+	}
+
+	attachments, attachmentBodies, err := decryptedAttachments(p)
+	if err != nil {
+		return err
+	}
+
+	etag := p.ETag()
+	p.changeEncryptionKey(key, salt)
+	if err := p.newVersion(); err != nil {
+		return err
+	}
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkSQLitePasteETag(tx, p.ID, etag); err != nil {
+		return err
+	}
+
+	for i, rev := range revs {
+		sealed, err := encryptPasteBody(p, revBodies[i])
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE paste_revisions SET body = ?, encryption_version = ?, compression = ? WHERE paste_id = ? AND number = ?", sealed, p.encryptionMethod, p.compression, p.ID.String(), rev.Number)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, a := range attachments {
+		sealed, err := encryptAttachmentBody(a, attachmentBodies[i])
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("UPDATE paste_attachments SET body = ?, encryption_version = ? WHERE paste_id = ? AND id = ?", sealed, a.encryptionMethod, p.ID.String(), a.key)
+		if err != nil {
+			return err
+		}
+	}
+
+	sealed, err := encryptPasteBody(p, body)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE pastes SET body = ? WHERE id = ?", sealed, p.ID.String()); err != nil {
+		return err
+	}
+
+	// Only how the body is stored changes, so as not to undo anything saved
+	// since p was loaded.
+	err = p.storeBodyMetadata(func(name string, value string) error {
+		_, err := tx.Exec("INSERT OR REPLACE INTO paste_metadata (paste_id, name, value) VALUES (?, ?, ?)", p.ID.String(), name, value)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	store.PasteUpdateCallback(p)
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// A paste's new body is written to a temporary file beside it (or in the paste
+// directory, for a new paste), named for the paste and a random number, which
+// is given the paste's metadata and renamed into place. With extended
+// attributes, the metadata goes along with the rename; a sidecar has to be
+// renamed on its own, after the body.
+//
+// Interrupted partway, that leaves one of:
+//
+//   - a temporary body (and maybe its sidecar), never committed; or
+//   - a temporary sidecar alone, whose body was committed without it.
+//
+// The first is thrown away, and the second is finished off.
+//
+// A password change writes a replacement for each of a paste's files, lists
+// them in a journal beside the paste, and only then moves them into place. If
+// it's interrupted once the journal is written, it's finished off before
+// anything else; before then, its replacements are thrown away like any other
+// uncommitted body.
+
+// replacementFilenamePattern matches a temporary file written by
+// ioutil.TempFile(dir, base+"."), and its sidecar.
+var replacementFilenamePattern = regexp.MustCompile(`^([^.]+)\.\d+(` + regexp.QuoteMeta(sidecarMetadataSuffix) + `)?$`)
+
+// RecoverInterruptedWrites cleans up after writes cut short by a crash. It
+// must be run before the store is put to use, as it can't tell an interrupted
+// write from one still underway.
+func (store *FilesystemPasteStore) RecoverInterruptedWrites() (int, error) {
+	n, err := store.recoverInterruptedReencryptions()
+	if err != nil {
+		return n, err
+	}
+
+	err = filepath.Walk(store.path, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// Gone already, along with a file recovered before it.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if fi.IsDir() {
+			if path == store.blobDirectory() || strings.HasSuffix(path, ".attachments") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if strings.HasSuffix(path, sidecarMetadataSuffix+".atomic") {
+			os.Remove(path)
+			return nil
+		}
+
+		m := replacementFilenamePattern.FindStringSubmatch(fi.Name())
+		if m == nil {
+			return nil
+		}
+
+		recovered, err := store.recoverInterruptedWrite(path, m[1], m[2] != "")
+		if err != nil {
+			glog.Errorf("Failed to recover %s: %v", path, err)
+		}
+		if recovered {
+			n++
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (store *FilesystemPasteStore) recoverInterruptedWrite(path, base string, sidecar bool) (bool, error) {
+	if !sidecar {
+		// Its sidecar, if it has one, is removed along with it.
+		if _, err := os.Stat(path + sidecarMetadataSuffix); err == nil {
+			return false, nil
+		}
+		glog.Warningf("Removing uncommitted paste body %s.", path)
+		return false, os.Remove(path)
+	}
+
+	name := strings.TrimSuffix(path, sidecarMetadataSuffix)
+	if _, err := os.Stat(name); err == nil {
+		glog.Warningf("Removing uncommitted paste body %s.", name)
+		os.Remove(path)
+		return false, os.Remove(name)
+	}
+
+	// New pastes are written in the paste directory, whatever the layout.
+	filename := filepath.Join(filepath.Dir(path), base)
+	if filepath.Dir(path) == store.path {
+		filename = store.filenameForID(PasteIDFromString(base))
+	}
+	if _, err := os.Stat(filename); err != nil {
+		glog.Warningf("Removing metadata %s, whose paste is gone.", path)
+		return false, os.Remove(path)
+	}
+
+	glog.Warningf("Committing metadata %s to %s.", path, filename)
+	return true, os.Rename(path, filename+sidecarMetadataSuffix)
+}
+
+// recoverInterruptedReencryptions finishes every password change whose
+// journal was written, and throws away the journals of those that weren't.
+func (store *FilesystemPasteStore) recoverInterruptedReencryptions() (int, error) {
+	n := 0
+	err := filepath.Walk(store.path, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if fi.IsDir() {
+			if path == store.blobDirectory() || strings.HasSuffix(path, ".revs") || strings.HasSuffix(path, ".attachments") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if strings.HasSuffix(path, reencryptionJournalSuffix+".atomic") {
+			os.Remove(path)
+			return nil
+		}
+
+		if !strings.HasSuffix(path, reencryptionJournalSuffix) {
+			return nil
+		}
+
+		// Should it fail, nothing else is recovered: the replacements it
+		// still lists would look uncommitted, and be thrown away.
+		glog.Warningf("Finishing the password change recorded in %s.", path)
+		if err := store.finishReencryption(path); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// PasteRevision is an immutable snapshot of a paste's body, language and title,
+// taken every time the paste is saved. Revisions are numbered from 1; the
+// newest revision always matches the paste itself.
+type PasteRevision struct {
+	Number   int
+	Language *Language
+	Title    string
+	Files    []*PasteFile
+
+	paste            *Paste
+	mtime            time.Time
+	encryptionMethod string
+	compression      string
+	blob             string
+	version          string
+}
+
+type PasteRevisionNotFoundError struct {
+	ID     PasteID
+	Number int
+}
+
+func (e PasteRevisionNotFoundError) Error() string {
+	return fmt.Sprintf("Paste %v has no revision %d.", e.ID, e.Number)
+}
+
+func (r *PasteRevision) Paste() *Paste {
+	return r.paste
+}
+
+func (r *PasteRevision) LastModified() time.Time {
+	return r.mtime
+}
+
+func (r *PasteRevision) ETag() string {
+	return pasteETag(r.version, r.mtime)
+}
+
+func (r *PasteRevision) Reader() (*PasteReader, error) {
+	return r.paste.store.readRevisionStream(r)
+}
+
+// Revisions returns every revision of p, oldest first.
+func (p *Paste) Revisions() ([]*PasteRevision, error) {
+	return p.store.Revisions(p)
+}
+
+func (p *Paste) Revision(n int) (*PasteRevision, error) {
+	revs, err := p.Revisions()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rev := range revs {
+		if rev.Number == n {
+			return rev, nil
+		}
+	}
+	return nil, PasteRevisionNotFoundError{ID: p.ID, Number: n}
+}
+
+// loadMetadata populates r from a store's metadata for the revision.
+func (r *PasteRevision) loadMetadata(get metadataGetter) {
+	r.Language = LanguageNamed(get("language", "text"))
+	r.Title = get("title", "")
+	r.Files, _ = decodePasteFiles(get("files", ""))
+	r.encryptionMethod = get("encryption_version", "")
+	if r.paste.Encrypted && r.encryptionMethod == "" {
+		r.encryptionMethod = "1"
+	}
+	r.compression = get("compression", "")
+	r.blob = get("blob", "")
+	r.version = get("version", "")
+}
+
+// revisionMetadata returns the metadata a store needs to keep for p's next revision.
+func revisionMetadata(p *Paste) map[string]string {
+	md := map[string]string{
+		"language": p.Language.ID,
+		"title":    p.Title,
+	}
+	if p.Encrypted {
+		md["encryption_version"] = p.encryptionMethod
+	}
+	if len(p.Files) > 0 {
+		md["files"] = encodePasteFiles(p.Files)
+	}
+	if p.compression != "" {
+		md["compression"] = p.compression
+	}
+	if p.blob != "" {
+		md["blob"] = p.blob
+	}
+	if p.version != "" {
+		md["version"] = p.version
+	}
+	return md
+}
+
+func (store *FilesystemPasteStore) revisionDirectoryForID(id PasteID) string {
+	return store.locate(id, ".revs")
+}
+
+func (store *FilesystemPasteStore) revisionNumbers(id PasteID) ([]int, error) {
+	dir, err := os.Open(store.revisionDirectoryForID(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer dir.Close()
+
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	numbers := make([]int, 0, len(names))
+	for _, name := range names {
+		// Sidecars and files that are still being written carry an extension.
+		if filepath.Ext(name) != "" {
+			continue
+		}
+
+		if n, err := strconv.Atoi(name); err == nil {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+func (store *FilesystemPasteStore) Revisions(p *Paste) ([]*PasteRevision, error) {
+	numbers, err := store.revisionNumbers(p.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	revs := make([]*PasteRevision, 0, len(numbers))
+	for _, n := range numbers {
+		filename := filepath.Join(store.revisionDirectoryForID(p.ID), strconv.Itoa(n))
+		stat, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		md, err := store.loadMetadata(filename)
+		if err != nil {
+			return nil, err
+		}
+
+		rev := &PasteRevision{Number: n, paste: p, mtime: stat.ModTime()}
+		rev.loadMetadata(func(name string, dflt string) string {
+			if v, ok := md[name]; ok {
+				return v
+			}
+			return dflt
+		})
+		revs = append(revs, rev)
+	}
+	return revs, nil
+}
+
+func (store *FilesystemPasteStore) readRevisionStream(rev *PasteRevision) (*PasteReader, error) {
+	p := rev.paste
+	filename := store.bodyFilename(filepath.Join(store.revisionDirectoryForID(p.ID), strconv.Itoa(rev.Number)), rev.blob)
+	var r io.ReadCloser
+	var err error
+	if r, err = os.Open(filename); err != nil {
+		return nil, err
+	}
+
+	if p.Encrypted {
+		r = encryptionMethodHandlers[rev.encryptionMethod].encryptedReadWrapper(p, r)
+	}
+
+	if r, err = decompressedPasteReader(rev.compression, r); err != nil {
+		return nil, err
+	}
+
+	return &PasteReader{ReadCloser: r, paste: p}, nil
+}
+
+// addRevision snapshots src, a paste file for id exactly as it is on disk, as
+// its next revision, returning the revision's number. The caller holds
+// metadataLock, so that the paste file doesn't change underneath it.
+func (store *FilesystemPasteStore) addRevision(id PasteID, src string, md map[string]string) (int, error) {
+	numbers, err := store.revisionNumbers(id)
+	if err != nil {
+		return 0, err
+	}
+
+	next := 1
+	if len(numbers) > 0 {
+		next = numbers[len(numbers)-1] + 1
+	}
+
+	revdir := store.revisionDirectoryForID(id)
+	if err := os.MkdirAll(revdir, 0700); err != nil {
+		return 0, err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	// The revision is dated with the paste, so that the two share an ETag.
+	fi, err := in.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if sum := md["blob"]; sum != "" {
+		if err := store.addBlobReference(sum, revisionBlobReferrer(id, next)); err != nil {
+			return 0, err
+		}
+	}
+
+	filename := filepath.Join(revdir, strconv.Itoa(next))
+	dst, err := ioutil.TempFile(revdir, strconv.Itoa(next)+".")
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = io.Copy(dst, in)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = store.metadata.Store(dst.Name(), md)
+	}
+	if err == nil {
+		err = os.Chtimes(dst.Name(), fi.ModTime(), fi.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(dst.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return 0, err
+	}
+
+	if _, ok := store.metadata.(sidecarMetadataBackend); ok {
+		if err := os.Rename(dst.Name()+sidecarMetadataSuffix, filename+sidecarMetadataSuffix); err != nil {
+			return 0, err
+		}
+	}
+	return next, nil
+}
+
+// removeRevision takes back revision n of id, for a body that in the end was
+// never saved.
+func (store *FilesystemPasteStore) removeRevision(id PasteID, n int, md map[string]string) {
+	store.removeReplacementFile(filepath.Join(store.revisionDirectoryForID(id), strconv.Itoa(n)))
+	if sum := md["blob"]; sum != "" {
+		store.releaseBlobReference(sum, revisionBlobReferrer(id, n))
+	}
+}
+
+// addLegacyRevision preserves the body of a paste written before revisions
+// existed as its first revision, before it's overwritten.
+func (store *FilesystemPasteStore) addLegacyRevision(p *Paste) error {
+	store.metadataLock.Lock()
+	defer store.metadataLock.Unlock()
+
+	numbers, err := store.revisionNumbers(p.ID)
+	if err != nil || len(numbers) > 0 {
+		return err
+	}
+
+	filename := store.filenameForID(p.ID)
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil
+	}
+
+	md, err := store.loadMetadata(filename)
+	if err != nil {
+		return err
+	}
+
+	legacy := make(map[string]string)
+	for _, name := range []string{"language", "title", "encryption_version", "files", "compression", "blob", "version"} {
+		if v, ok := md[name]; ok {
+			legacy[name] = v
+		}
+	}
+	_, err = store.addRevision(p.ID, filename, legacy)
+	return err
+}
+
+// filesystemPasteBodyWriter writes a paste's new body beside the paste file.
+// Once it's complete, it's given the paste's metadata and renamed over the
+// paste file, so that the body and metadata are replaced together. It's
+// recorded as a new revision just before, under the same lock. If the store deduplicates
+// bodies, the body is hashed as it's written and moved into its blob instead,
+// leaving an empty paste file.
+type filesystemPasteBodyWriter struct {
+	*os.File
+	store *FilesystemPasteStore
+	paste *Paste
+	hash  hash.Hash
+}
+
+func (w *filesystemPasteBodyWriter) Write(b []byte) (int, error) {
+	n, err := w.File.Write(b)
+	if w.hash != nil {
+		w.hash.Write(b[:n])
+	}
+	return n, err
+}
+
+func (w *filesystemPasteBodyWriter) Close() error {
+	if err := w.File.Close(); err != nil {
+		w.store.removeReplacementFile(w.Name())
+		return err
+	}
+
+	name := w.Name()
+	w.paste.blob = ""
+	if w.hash != nil {
+		sum := hex.EncodeToString(w.hash.Sum(nil))
+		empty, err := w.store.storeBlob(name, w.paste.ID, sum)
+		if err != nil {
+			w.store.removeReplacementFile(name)
+			return err
+		}
+		name, w.paste.blob = empty, sum
+	}
+
+	previousBlob, err := w.replacePasteFile(name)
+	if err != nil {
+		w.store.removeReplacementFile(name)
+		return err
+	}
+	if previousBlob != "" && previousBlob != w.paste.blob {
+		w.store.releaseBlobReference(previousBlob, pasteBlobReferrer(w.paste.ID))
+	}
+	w.store.PasteUpdateCallback(w.paste)
+	return nil
+}
+
+// replacePasteFile moves replacement over the paste file, returning the blob
+// the paste's body was in before, if any, and records it as the paste's next
+// revision. It refuses to if somebody else has replaced the paste file since
+// the paste was loaded.
+func (w *filesystemPasteBodyWriter) replacePasteFile(replacement string) (string, error) {
+	w.store.metadataLock.Lock()
+	defer w.store.metadataLock.Unlock()
+
+	filename := w.store.filenameForID(w.paste.ID)
+	md, err := w.store.loadMetadata(filename)
+	if err != nil {
+		return "", err
+	}
+
+	if !w.paste.mtime.IsZero() {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return "", err
+		}
+		if pasteETag(md["version"], fi.ModTime()) != w.paste.ETag() {
+			return "", PasteModifiedError{ID: w.paste.ID}
+		}
+	}
+	previousBlob := md["blob"]
+
+	// w.paste takes on the new version only once the body's in place.
+	written := w.paste.writtenPaste()
+	if err := written.newVersion(); err != nil {
+		return "", err
+	}
+
+	// Anything the paste doesn't write for itself (like its views) is kept.
+	put := func(name string, value string) error {
+		md[name] = value
+		return nil
+	}
+	written.storeMetadata(put)
+	written.storeBodyMetadata(put)
+	if err := w.store.metadata.Store(replacement, md); err != nil {
+		return "", err
+	}
+
+	// A new paste's shard directories may not exist yet.
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return "", err
+	}
+
+	// Taken from the replacement, as nobody else can replace the paste file
+	// between here and the rename.
+	revmd := revisionMetadata(written)
+	n, err := w.store.addRevision(w.paste.ID, replacement, revmd)
+	if err != nil {
+		return "", err
+	}
+	if err := w.store.replaceFile(replacement, filename); err != nil {
+		w.store.removeRevision(w.paste.ID, n, revmd)
+		return "", err
+	}
+	w.paste.version, w.paste.encryptionMethod = written.version, written.encryptionMethod
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+	w.paste.mtime = fi.ModTime()
+	return previousBlob, nil
+}
+
+func (w *filesystemPasteBodyWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.Name())
+}
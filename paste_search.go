@@ -0,0 +1,213 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/golang/glog"
+)
+
+// The search index holds the words in the body of every paste somebody has
+// searched for since the server started. A paste's body is indexed the first
+// time a search comes across it, and again the first time after it's been
+// replaced; each body's words are kept along with the ETag of the body they
+// came from, so words from a body that's since been replaced are never used.
+// Its title and language are cheap enough to look at afresh every time.
+// Searches only ever look at the pastes a session can edit or its account
+// owns, so there's never a need to look up words across the whole store.
+//
+// An encrypted paste's body and title are never indexed, as the index is kept
+// in plaintext; one can only be found by its language.
+
+// searchIndexBodyLimit bounds how much of a paste's body is indexed.
+const searchIndexBodyLimit = 1 << 20
+
+type pasteIndexEntry struct {
+	language     *Language
+	titleTerms   []string
+	bodyTerms    []string
+	unsearchable bool
+}
+
+// pasteIndexBody is the words in a paste's body, as of the body with etag.
+type pasteIndexBody struct {
+	etag  string
+	terms []string
+}
+
+type PasteIndex struct {
+	mu     sync.RWMutex
+	bodies map[PasteID]*pasteIndexBody
+}
+
+var pasteIndex = &PasteIndex{bodies: make(map[PasteID]*pasteIndexBody)}
+
+// searchTerms splits text into the distinct, lowercased words in it, sorted.
+func searchTerms(text string) []string {
+	seen := make(map[string]bool)
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c) && c != '_'
+	}) {
+		seen[word] = true
+	}
+
+	terms := make([]string, 0, len(seen))
+	for word := range seen {
+		terms = append(terms, word)
+	}
+	sort.Strings(terms)
+	return terms
+}
+
+// hasTermWithPrefix reports whether any of the sorted terms starts with prefix.
+func hasTermWithPrefix(terms []string, prefix string) bool {
+	i := sort.SearchStrings(terms, prefix)
+	return i < len(terms) && strings.HasPrefix(terms[i], prefix)
+}
+
+func readPasteBodyTerms(p *Paste) []string {
+	reader, err := p.Reader()
+	if err != nil {
+		glog.Errorf("Failed to index paste %v: %v", p.ID, err)
+		return nil
+	}
+	defer reader.Close()
+
+	body := &strings.Builder{}
+	if _, err := io.Copy(body, io.LimitReader(reader, searchIndexBodyLimit)); err != nil {
+		glog.Errorf("Failed to index paste %v: %v", p.ID, err)
+	}
+	return searchTerms(body.String())
+}
+
+// Update forgets the words in p's body, unless they're the words in the body
+// it was just saved with. Not every save replaces the body (its title, say);
+// those that don't leave its words be.
+func (idx *PasteIndex) Update(p *Paste) {
+	idx.mu.Lock()
+	if b, ok := idx.bodies[p.ID]; ok && b.etag != p.ETag() {
+		delete(idx.bodies, p.ID)
+	}
+	idx.mu.Unlock()
+}
+
+func (idx *PasteIndex) Remove(p *Paste) {
+	idx.mu.Lock()
+	delete(idx.bodies, p.ID)
+	idx.mu.Unlock()
+}
+
+// bodyTerms returns the words in p's body, reading it unless the body p was
+// loaded with has already been indexed. A p loaded before its body was
+// replaced may leave the index holding the words of the body it was loaded
+// with, but under that body's ETag; they're read again the next time they're
+// wanted for the new one.
+func (idx *PasteIndex) bodyTerms(p *Paste) []string {
+	etag := p.ETag()
+	idx.mu.RLock()
+	b, ok := idx.bodies[p.ID]
+	idx.mu.RUnlock()
+	if ok && b.etag == etag {
+		return b.terms
+	}
+
+	terms := readPasteBodyTerms(p)
+	idx.mu.Lock()
+	idx.bodies[p.ID] = &pasteIndexBody{etag: etag, terms: terms}
+	idx.mu.Unlock()
+	return terms
+}
+
+// entry returns what a search can match p by.
+func (idx *PasteIndex) entry(p *Paste) *pasteIndexEntry {
+	e := &pasteIndexEntry{language: p.Language}
+	if p.Encrypted || p.ClientEncryption != "" {
+		e.unsearchable = true
+		return e
+	}
+
+	names := []string{p.Title}
+	for _, f := range p.Files {
+		names = append(names, f.Name)
+	}
+	e.titleTerms = searchTerms(strings.Join(names, " "))
+	e.bodyTerms = idx.bodyTerms(p)
+	return e
+}
+
+// PasteSearchQuery is a search broken up into what it's looking for. Words
+// can be found anywhere in a paste; "title:" and "body:" words only there.
+// "lang:" picks out pastes in a language, by its name or ID.
+type PasteSearchQuery struct {
+	Terms      []string
+	TitleTerms []string
+	BodyTerms  []string
+	Language   string
+}
+
+func ParsePasteSearchQuery(q string) *PasteSearchQuery {
+	query := &PasteSearchQuery{}
+	for _, field := range strings.Fields(q) {
+		filter, value := "", field
+		if i := strings.Index(field, ":"); i > 0 {
+			filter, value = strings.ToLower(field[:i]), field[i+1:]
+		}
+
+		switch filter {
+		case "lang", "language":
+			query.Language = strings.ToLower(value)
+		case "title":
+			query.TitleTerms = append(query.TitleTerms, searchTerms(value)...)
+		case "body":
+			query.BodyTerms = append(query.BodyTerms, searchTerms(value)...)
+		default:
+			query.Terms = append(query.Terms, searchTerms(field)...)
+		}
+	}
+	return query
+}
+
+func (q *PasteSearchQuery) Empty() bool {
+	return len(q.Terms) == 0 && len(q.TitleTerms) == 0 && len(q.BodyTerms) == 0 && q.Language == ""
+}
+
+func (q *PasteSearchQuery) matches(e *pasteIndexEntry) bool {
+	if q.Language != "" && (e.language == nil || (strings.ToLower(e.language.ID) != q.Language && strings.ToLower(e.language.Name) != q.Language)) {
+		return false
+	}
+
+	if e.unsearchable && (len(q.Terms) > 0 || len(q.TitleTerms) > 0 || len(q.BodyTerms) > 0) {
+		return false
+	}
+
+	for _, term := range q.TitleTerms {
+		if !hasTermWithPrefix(e.titleTerms, term) {
+			return false
+		}
+	}
+	for _, term := range q.BodyTerms {
+		if !hasTermWithPrefix(e.bodyTerms, term) {
+			return false
+		}
+	}
+	for _, term := range q.Terms {
+		if !hasTermWithPrefix(e.titleTerms, term) && !hasTermWithPrefix(e.bodyTerms, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// Search returns those of pastes that match q, in the same order.
+func (idx *PasteIndex) Search(pastes []*Paste, q *PasteSearchQuery) []*Paste {
+	var found []*Paste
+	for _, p := range pastes {
+		if q.matches(idx.entry(p)) {
+			found = append(found, p)
+		}
+	}
+	return found
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// A paste's body can be served a piece at a time, for range requests. A body
+// stored as it is, or encrypted with method 2 (AES-CTR) or 3 (AES-GCM chunks),
+// is seeked through directly, decrypting only what's read; anything else (a
+// compressed body, or one encrypted with method 1's OFB) has to be read from
+// the start up to wherever it's seeked to.
+
+type readSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
+
+var errNegativeSeek = errors.New("seek to a negative position")
+
+// seekPosition works out where a seek ends up, given where the reader is and
+// how long the body is.
+func seekPosition(pos, size, offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += pos
+	case io.SeekEnd:
+		offset += size
+	}
+	if offset < 0 {
+		return pos, errNegativeSeek
+	}
+	return offset, nil
+}
+
+// SeekableReader reads p's body, like Reader, from wherever it's seeked to.
+func (p *Paste) SeekableReader() (readSeekCloser, error) {
+	if p.compression != "" || (p.Encrypted && p.encryptionMethod != "2" && p.encryptionMethod != "3") {
+		size := int64(-1)
+		if p.compression == "" {
+			// OFB leaves the length alone.
+			if n, err := p.Length(); err == nil {
+				size = n
+			}
+		}
+		return &forwardSeeker{open: func() (io.ReadCloser, error) { return p.Reader() }, size: size}, nil
+	}
+
+	body, err := p.store.openBody(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.Encrypted {
+		return body, nil
+	} else if p.encryptionMethod == "2" {
+		return newCTRSeeker(p, body)
+	}
+	return newGCMChunkSeeker(p, body)
+}
+
+// ctrSeeker decrypts a body encrypted with method 2. Its counter starts from
+// zero, so the keystream for any block can be had by starting it there.
+type ctrSeeker struct {
+	r      readSeekCloser
+	block  cipher.Block
+	stream cipher.Stream
+}
+
+func newCTRSeeker(p *Paste, r readSeekCloser) (readSeekCloser, error) {
+	block, err := aes.NewCipher(p.encryptionKey)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	s := &ctrSeeker{r: r, block: block}
+	if _, err := s.Seek(0, io.SeekStart); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ctrSeeker) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	s.stream.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+func (s *ctrSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := s.r.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+
+	var iv [aes.BlockSize]byte
+	binary.BigEndian.PutUint64(iv[aes.BlockSize-8:], uint64(pos/aes.BlockSize))
+	s.stream = cipher.NewCTR(s.block, iv[:])
+
+	skip := make([]byte, pos%aes.BlockSize)
+	s.stream.XORKeyStream(skip, skip)
+	return pos, nil
+}
+
+func (s *ctrSeeker) Close() error {
+	return s.r.Close()
+}
+
+// gcmChunkSeeker decrypts a body encrypted with method 3 a chunk at a time,
+// opening whichever chunk it's been seeked into. Every chunk but the last is
+// full, so where each one is, and which is last, follows from the length of
+// the body; a body that's been truncated or extended fails authentication
+// just as it does when it's read from the start.
+type gcmChunkSeeker struct {
+	r      readSeekCloser
+	aead   cipher.AEAD
+	ad     []byte
+	prefix []byte
+	chunks int64
+	size   int64
+	pos    int64
+	index  int64
+	sealed []byte
+	buf    []byte
+}
+
+func newGCMChunkSeeker(p *Paste, r readSeekCloser) (readSeekCloser, error) {
+	s, err := openGCMChunkSeeker(p, r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func openGCMChunkSeeker(p *Paste, r readSeekCloser) (*gcmChunkSeeker, error) {
+	aead, err := gcmForPaste(p)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	s := &gcmChunkSeeker{r: r, aead: aead, ad: []byte(p.ID.String()), index: -1}
+	s.prefix = make([]byte, gcmPrefixSize)
+	if _, err := io.ReadFull(r, s.prefix); err != nil {
+		return nil, errGCMBodyTampered
+	}
+
+	sealedSize := int64(gcmChunkSize + aead.Overhead())
+	sealed := stored - gcmPrefixSize
+	s.chunks = (sealed + sealedSize - 1) / sealedSize
+	if s.chunks == 0 || sealed-(s.chunks-1)*sealedSize < int64(aead.Overhead()) {
+		return nil, errGCMBodyTampered
+	}
+	s.size = sealed - s.chunks*int64(aead.Overhead())
+	s.sealed = make([]byte, sealedSize)
+	return s, nil
+}
+
+func (s *gcmChunkSeeker) open(index int64) error {
+	s.index = -1
+	offset := gcmPrefixSize + index*int64(len(s.sealed))
+	if _, err := s.r.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	n, err := io.ReadFull(s.r, s.sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return errGCMBodyTampered
+	}
+
+	final := byte(gcmMiddleChunk)
+	if index == s.chunks-1 {
+		final = gcmFinalChunk
+	}
+	s.buf, err = s.aead.Open(s.buf[:0], gcmNonce(s.prefix, uint32(index), final), s.sealed[:n], s.ad)
+	if err != nil {
+		return errGCMBodyTampered
+	}
+	s.index = index
+	return nil
+}
+
+func (s *gcmChunkSeeker) Read(b []byte) (int, error) {
+	if s.pos >= s.size {
+		return 0, io.EOF
+	}
+
+	index := s.pos / gcmChunkSize
+	if index != s.index {
+		if err := s.open(index); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, s.buf[s.pos-index*gcmChunkSize:])
+	s.pos += int64(n)
+	return n, nil
+}
+
+func (s *gcmChunkSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := seekPosition(s.pos, s.size, offset, whence)
+	s.pos = pos
+	return pos, err
+}
+
+func (s *gcmChunkSeeker) Close() error {
+	return s.r.Close()
+}
+
+// forwardSeeker seeks through a body that can only be read from the start,
+// reading (and throwing away) everything up to where it's been seeked to,
+// and starting over to go back. Unless it's told how long the body is, it
+// reads the whole thing the first time it's seeked from the end.
+type forwardSeeker struct {
+	open func() (io.ReadCloser, error)
+	r    io.ReadCloser
+	// pos is how far into the body r is, and want where the next read starts.
+	pos, want int64
+	size      int64
+}
+
+func (s *forwardSeeker) reopen() error {
+	if s.r != nil {
+		s.r.Close()
+		s.r = nil
+	}
+
+	r, err := s.open()
+	if err != nil {
+		return err
+	}
+	s.r, s.pos = r, 0
+	return nil
+}
+
+func (s *forwardSeeker) Read(b []byte) (int, error) {
+	if s.r == nil || s.want < s.pos {
+		if err := s.reopen(); err != nil {
+			return 0, err
+		}
+	}
+
+	if s.want > s.pos {
+		n, err := io.CopyN(ioutil.Discard, s.r, s.want-s.pos)
+		s.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := s.r.Read(b)
+	s.pos += int64(n)
+	s.want = s.pos
+	return n, err
+}
+
+func (s *forwardSeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekEnd && s.size < 0 {
+		r, err := s.open()
+		if err != nil {
+			return s.want, err
+		}
+		s.size, err = io.Copy(ioutil.Discard, r)
+		r.Close()
+		if err != nil {
+			s.size = -1
+			return s.want, err
+		}
+	}
+
+	pos, err := seekPosition(s.want, s.size, offset, whence)
+	s.want = pos
+	return pos, err
+}
+
+func (s *forwardSeeker) Close() error {
+	if s.r == nil {
+		return nil
+	}
+	return s.r.Close()
+}
@@ -0,0 +1,675 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqlitePasteSchema = `
+CREATE TABLE IF NOT EXISTS pastes (
+	id    TEXT PRIMARY KEY,
+	body  BLOB NOT NULL DEFAULT x'',
+	mtime INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS paste_metadata (
+	paste_id TEXT NOT NULL,
+	name     TEXT NOT NULL,
+	value    TEXT NOT NULL,
+	PRIMARY KEY (paste_id, name)
+);
+CREATE INDEX IF NOT EXISTS paste_metadata_values ON paste_metadata (name, value);
+CREATE TABLE IF NOT EXISTS paste_revisions (
+	paste_id           TEXT NOT NULL,
+	number             INTEGER NOT NULL,
+	body               BLOB NOT NULL,
+	language           TEXT NOT NULL,
+	title              TEXT NOT NULL,
+	encryption_version TEXT NOT NULL,
+	files              TEXT NOT NULL DEFAULT '',
+	compression        TEXT NOT NULL DEFAULT '',
+	version            TEXT NOT NULL DEFAULT '',
+	mtime              INTEGER NOT NULL,
+	PRIMARY KEY (paste_id, number)
+);
+CREATE TABLE IF NOT EXISTS paste_attachments (
+	paste_id           TEXT NOT NULL,
+	id                 TEXT NOT NULL,
+	name               TEXT NOT NULL,
+	content_type       TEXT NOT NULL,
+	length             INTEGER NOT NULL,
+	encryption_version TEXT NOT NULL,
+	body               BLOB NOT NULL,
+	mtime              INTEGER NOT NULL,
+	PRIMARY KEY (paste_id, id)
+);
+`
+
+// sqliteColumnAdditions brings tables created by older versions of the schema up to date.
+var sqliteColumnAdditions = []struct{ table, column, definition string }{
+	{"paste_revisions", "files", "TEXT NOT NULL DEFAULT ''"},
+	{"paste_revisions", "compression", "TEXT NOT NULL DEFAULT ''"},
+	{"paste_revisions", "version", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// SQLitePasteStore keeps paste bodies and their metadata in a single SQLite
+// database. Metadata is stored under the same names FilesystemPasteStore uses
+// for its extended attributes.
+type SQLitePasteStore struct {
+	PasteUpdateCallback  PasteCallback
+	PasteDestroyCallback PasteCallback
+	// BodyLimit, if it's positive, bounds the size of a paste body or an
+	// attachment, as written; see sqliteBodyBuffer.
+	BodyLimit int64
+	db        *sql.DB
+}
+
+// PasteStoreLimitError is a paste body or attachment larger than the store
+// will take.
+type PasteStoreLimitError int64
+
+func (e PasteStoreLimitError) Error() string {
+	return fmt.Sprintf("That's more than can be stored at once, which is %v.", ByteSize(e))
+}
+
+// sqliteBodyBuffer holds a body on its way into the database. SQLite can't
+// take a blob a piece at a time, so all of it is held in memory until it's
+// committed (and, for a paste body, held twice over while it's copied into a
+// revision); limit, if it's positive, bounds how much that can be.
+type sqliteBodyBuffer struct {
+	buf   bytes.Buffer
+	limit int64
+}
+
+func (b *sqliteBodyBuffer) Write(p []byte) (int, error) {
+	if b.limit > 0 && int64(b.buf.Len()+len(p)) > b.limit {
+		return 0, PasteStoreLimitError(b.limit)
+	}
+	return b.buf.Write(p)
+}
+
+func (b *sqliteBodyBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+func (b *sqliteBodyBuffer) Reset() {
+	b.buf.Reset()
+}
+
+func NewSQLitePasteStore(path string) (*SQLitePasteStore, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only tolerates a single writer; funnel everything through one connection
+	// instead of fielding "database is locked" errors.
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqlitePasteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	for _, c := range sqliteColumnAdditions {
+		if err := addSQLiteColumn(db, c.table, c.column, c.definition); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return &SQLitePasteStore{
+		db:                   db,
+		PasteUpdateCallback:  PasteCallback(noopPasteCallback),
+		PasteDestroyCallback: PasteCallback(noopPasteCallback),
+	}, nil
+}
+
+func addSQLiteColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notnull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+func (store *SQLitePasteStore) exists(id PasteID) (bool, error) {
+	var n int
+	err := store.db.QueryRow("SELECT COUNT(*) FROM pastes WHERE id = ?", id.String()).Scan(&n)
+	return n > 0, err
+}
+
+// pasteIDs lists the IDs of every paste in the store.
+func (store *SQLitePasteStore) pasteIDs() ([]PasteID, error) {
+	rows, err := store.db.Query("SELECT id FROM pastes")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []PasteID
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, PasteIDFromString(id))
+	}
+	return ids, rows.Err()
+}
+
+func (store *SQLitePasteStore) GenerateNewPasteID(encrypted bool) (PasteID, error) {
+	nbytes, idlen := 4, 5
+	if encrypted {
+		nbytes, idlen = 5, 8
+	}
+
+	for {
+		s, err := generateRandomBase32String(nbytes, idlen)
+		if err != nil {
+			return "", err
+		}
+
+		exists, err := store.exists(PasteIDFromString(s))
+		if err != nil {
+			return "", err
+		}
+
+		if !exists {
+			return PasteIDFromString(s), nil
+		}
+	}
+}
+
+func (store *SQLitePasteStore) New(encrypted bool) (p *Paste, err error) {
+	id, err := store.GenerateNewPasteID(encrypted)
+	if err != nil {
+		panic(err)
+	}
+
+	p = &Paste{ID: id, store: store, created: time.Now().UTC().Truncate(time.Second)}
+
+	if encrypted {
+		p.encryptionSalt, _ = generateRandomBytes(16)
+	}
+
+	return
+}
+
+func (store *SQLitePasteStore) bodyLength(p *Paste) (int64, error) {
+	var n int64
+	err := store.db.QueryRow("SELECT length(body) FROM pastes WHERE id = ?", p.ID.String()).Scan(&n)
+	if err == sql.ErrNoRows {
+		err = PasteNotFoundError{ID: p.ID}
+	}
+	return n, err
+}
+
+// sqliteQuerier is either the database or a transaction on it. Anything done
+// during a transaction has to go through it: the database only has the one
+// connection, which the transaction is holding.
+type sqliteQuerier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func sqliteMetadata(q sqliteQuerier, id PasteID) (map[string]string, error) {
+	rows, err := q.Query("SELECT name, value FROM paste_metadata WHERE paste_id = ?", id.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	md := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		md[name] = value
+	}
+	return md, rows.Err()
+}
+
+func (store *SQLitePasteStore) Get(id PasteID, key []byte) (p *Paste, err error) {
+	var mtime int64
+	err = store.db.QueryRow("SELECT mtime FROM pastes WHERE id = ?", id.String()).Scan(&mtime)
+	if err == sql.ErrNoRows {
+		err = PasteNotFoundError{ID: id}
+		return
+	} else if err != nil {
+		return
+	}
+
+	md, err := sqliteMetadata(store.db, id)
+	if err != nil {
+		return
+	}
+
+	paste := &Paste{ID: id, store: store, mtime: time.Unix(0, mtime)}
+	err = paste.loadMetadata(func(name string, dflt string) string {
+		if v, ok := md[name]; ok {
+			return v
+		}
+		return dflt
+	}, key)
+	if _, ok := err.(PasteEncryptedError); err != nil && !ok {
+		return
+	}
+
+	p = paste
+	return
+}
+
+func (store *SQLitePasteStore) Save(p *Paste) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// A paste's metadata may be saved before its body is ever written.
+	_, err = tx.Exec("INSERT OR IGNORE INTO pastes (id, mtime) VALUES (?, ?)", p.ID.String(), time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+
+	err = p.storeMetadata(func(name string, value string) error {
+		_, err := tx.Exec("INSERT OR REPLACE INTO paste_metadata (paste_id, name, value) VALUES (?, ?, ?)", p.ID.String(), name, value)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	store.PasteUpdateCallback(p)
+	return nil
+}
+
+func (store *SQLitePasteStore) Destroy(p *Paste) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM pastes WHERE id = ?", p.ID.String())
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return PasteNotFoundError{ID: p.ID}
+	}
+
+	if _, err := tx.Exec("DELETE FROM paste_metadata WHERE paste_id = ?", p.ID.String()); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM paste_revisions WHERE paste_id = ?", p.ID.String()); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM paste_attachments WHERE paste_id = ?", p.ID.String()); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	store.PasteDestroyCallback(p)
+	return nil
+}
+
+func (store *SQLitePasteStore) EncryptionKeyForPasteWithPassword(p *Paste, password string) []byte {
+	return deriveEncryptionKey(p, password)
+}
+
+// openBody reads p's body, as it's stored, out of the database.
+func (store *SQLitePasteStore) openBody(p *Paste) (readSeekCloser, error) {
+	var body []byte
+	err := store.db.QueryRow("SELECT body FROM pastes WHERE id = ?", p.ID.String()).Scan(&body)
+	if err == sql.ErrNoRows {
+		return nil, PasteNotFoundError{ID: p.ID}
+	} else if err != nil {
+		return nil, err
+	}
+	return nopSeekCloser{bytes.NewReader(body)}, nil
+}
+
+func (store *SQLitePasteStore) readStream(p *Paste) (*PasteReader, error) {
+	var r io.ReadCloser
+	var err error
+	if r, err = store.openBody(p); err != nil {
+		return nil, err
+	}
+
+	if p.Encrypted {
+		r = encryptionMethodHandlers[p.encryptionMethod].encryptedReadWrapper(p, r)
+	}
+
+	if r, err = decompressedPasteReader(p.compression, r); err != nil {
+		return nil, err
+	}
+
+	return &PasteReader{ReadCloser: r, paste: p}, nil
+}
+
+func (store *SQLitePasteStore) Revisions(p *Paste) ([]*PasteRevision, error) {
+	rows, err := store.db.Query("SELECT number, language, title, encryption_version, files, compression, version, mtime FROM paste_revisions WHERE paste_id = ? ORDER BY number", p.ID.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var revs []*PasteRevision
+	for rows.Next() {
+		var number int
+		var mtime int64
+		md := make(map[string]string)
+		var language, title, encryptionVersion, files, compression, version string
+		if err := rows.Scan(&number, &language, &title, &encryptionVersion, &files, &compression, &version, &mtime); err != nil {
+			return nil, err
+		}
+
+		md["language"], md["title"], md["files"] = language, title, files
+		if encryptionVersion != "" {
+			md["encryption_version"] = encryptionVersion
+		}
+		if compression != "" {
+			md["compression"] = compression
+		}
+		if version != "" {
+			md["version"] = version
+		}
+
+		rev := &PasteRevision{Number: number, paste: p, mtime: time.Unix(0, mtime)}
+		rev.loadMetadata(func(name string, dflt string) string {
+			if v, ok := md[name]; ok {
+				return v
+			}
+			return dflt
+		})
+		revs = append(revs, rev)
+	}
+	return revs, rows.Err()
+}
+
+func (store *SQLitePasteStore) readRevisionStream(rev *PasteRevision) (*PasteReader, error) {
+	p := rev.paste
+	var body []byte
+	err := store.db.QueryRow("SELECT body FROM paste_revisions WHERE paste_id = ? AND number = ?", p.ID.String(), rev.Number).Scan(&body)
+	if err == sql.ErrNoRows {
+		return nil, PasteRevisionNotFoundError{ID: p.ID, Number: rev.Number}
+	} else if err != nil {
+		return nil, err
+	}
+
+	r := ioutil.NopCloser(bytes.NewReader(body))
+	if p.Encrypted {
+		r = encryptionMethodHandlers[rev.encryptionMethod].encryptedReadWrapper(p, r)
+	}
+
+	if r, err = decompressedPasteReader(rev.compression, r); err != nil {
+		return nil, err
+	}
+
+	return &PasteReader{ReadCloser: r, paste: p}, nil
+}
+
+// addSQLiteRevision records body as the next revision of the paste with the given ID.
+func addSQLiteRevision(tx *sql.Tx, id PasteID, body []byte, md map[string]string, mtime int64) error {
+	_, err := tx.Exec("INSERT INTO paste_revisions (paste_id, number, body, language, title, encryption_version, files, compression, version, mtime) SELECT ?, COALESCE(MAX(number), 0) + 1, ?, ?, ?, ?, ?, ?, ?, ? FROM paste_revisions WHERE paste_id = ?",
+		id.String(), body, md["language"], md["title"], md["encryption_version"], md["files"], md["compression"], md["version"], mtime, id.String())
+	return err
+}
+
+// addLegacyRevision preserves the body of a paste written before revisions
+// existed as its first revision, before it's overwritten.
+func (store *SQLitePasteStore) addLegacyRevision(p *Paste) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var n int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM paste_revisions WHERE paste_id = ?", p.ID.String()).Scan(&n); err != nil || n > 0 {
+		return err
+	}
+
+	var body []byte
+	var mtime int64
+	err = tx.QueryRow("SELECT body, mtime FROM pastes WHERE id = ?", p.ID.String()).Scan(&body, &mtime)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	md, err := sqliteMetadata(tx, p.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := addSQLiteRevision(tx, p.ID, body, md, mtime); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// checkSQLitePasteETag refuses, with PasteModifiedError, if the body of the
+// paste with id is no longer the one with etag.
+func checkSQLitePasteETag(tx *sql.Tx, id PasteID, etag string) error {
+	var mtime int64
+	var version string
+	err := tx.QueryRow("SELECT mtime, COALESCE((SELECT value FROM paste_metadata WHERE paste_id = pastes.id AND name = 'version'), '') FROM pastes WHERE id = ?", id.String()).Scan(&mtime, &version)
+	if err != nil {
+		return err
+	}
+	if pasteETag(version, time.Unix(0, mtime)) != etag {
+		return PasteModifiedError{ID: id}
+	}
+	return nil
+}
+
+// sqlitePasteBodyWriter buffers a paste body and commits it to the database,
+// along with the paste's metadata and a new revision, in one go when closed.
+type sqlitePasteBodyWriter struct {
+	sqliteBodyBuffer
+	store *SQLitePasteStore
+	paste *Paste
+}
+
+func (w *sqlitePasteBodyWriter) Close() error {
+	tx, err := w.store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	id, mtime := w.paste.ID, time.Now().UnixNano()
+	if !w.paste.mtime.IsZero() {
+		if err := checkSQLitePasteETag(tx, id, w.paste.ETag()); err != nil {
+			return err
+		}
+	}
+	written := w.paste.writtenPaste()
+	if err := written.newVersion(); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO pastes (id, body, mtime) VALUES (?, ?, ?) ON CONFLICT (id) DO UPDATE SET body = excluded.body, mtime = excluded.mtime", id.String(), w.Bytes(), mtime)
+	if err != nil {
+		return err
+	}
+
+	put := func(name string, value string) error {
+		_, err := tx.Exec("INSERT OR REPLACE INTO paste_metadata (paste_id, name, value) VALUES (?, ?, ?)", id.String(), name, value)
+		return err
+	}
+	if err := written.storeMetadata(put); err != nil {
+		return err
+	}
+	if err := written.storeBodyMetadata(put); err != nil {
+		return err
+	}
+
+	if err := addSQLiteRevision(tx, id, w.Bytes(), revisionMetadata(written), mtime); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	w.paste.version, w.paste.encryptionMethod = written.version, written.encryptionMethod
+	w.paste.mtime = time.Unix(0, mtime)
+	w.store.PasteUpdateCallback(w.paste)
+	return nil
+}
+
+func (w *sqlitePasteBodyWriter) Abort() error {
+	w.Reset()
+	return nil
+}
+
+func (store *SQLitePasteStore) writeStream(p *Paste) (*PasteWriter, error) {
+	if err := store.addLegacyRevision(p); err != nil {
+		return nil, err
+	}
+
+	return newPasteWriter(p, &sqlitePasteBodyWriter{sqliteBodyBuffer: sqliteBodyBuffer{limit: store.BodyLimit}, store: store, paste: p}), nil
+}
+
+// ImportFilesystemPasteStore copies every paste out of a FilesystemPasteStore,
+// byte-for-byte and along with its metadata, revisions and attachments.
+// Pastes that already exist in the database are left alone, so an interrupted
+// import can simply be run again. Encrypted pastes are copied without being
+// decrypted.
+func (store *SQLitePasteStore) ImportFilesystemPasteStore(fsStore *FilesystemPasteStore) (int, error) {
+	ids, err := fsStore.pasteIDs()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, id := range ids {
+		exists, err := store.exists(id)
+		if err != nil {
+			return n, err
+		}
+		if exists {
+			continue
+		}
+
+		if err := store.importFilesystemPaste(fsStore, id); err != nil {
+			glog.Errorf("Failed to import paste %v: %v", id, err)
+			continue
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (store *SQLitePasteStore) importFilesystemPaste(fsStore *FilesystemPasteStore, id PasteID) error {
+	filename := fsStore.filenameForID(id)
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	md, err := fsStore.loadMetadata(filename)
+	if err != nil {
+		return err
+	}
+
+	// Deduplicated bodies are brought in from their blobs.
+	body, err := ioutil.ReadFile(fsStore.bodyFilename(filename, md["blob"]))
+	if err != nil {
+		return err
+	}
+	delete(md, "blob")
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO pastes (id, body, mtime) VALUES (?, ?, ?)", id.String(), body, stat.ModTime().UnixNano())
+	if err != nil {
+		return err
+	}
+
+	for name, value := range md {
+		_, err := tx.Exec("INSERT INTO paste_metadata (paste_id, name, value) VALUES (?, ?, ?)", id.String(), name, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	numbers, err := fsStore.revisionNumbers(id)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range numbers {
+		revFilename := filepath.Join(fsStore.revisionDirectoryForID(id), strconv.Itoa(n))
+		stat, err := os.Stat(revFilename)
+		if err != nil {
+			return err
+		}
+
+		md, err := fsStore.loadMetadata(revFilename)
+		if err != nil {
+			return err
+		}
+
+		body, err := ioutil.ReadFile(fsStore.bodyFilename(revFilename, md["blob"]))
+		if err != nil {
+			return err
+		}
+
+		if err := addSQLiteRevision(tx, id, body, md, stat.ModTime().UnixNano()); err != nil {
+			return err
+		}
+	}
+
+	if err := store.importFilesystemAttachments(tx, fsStore, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
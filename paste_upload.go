@@ -0,0 +1,370 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/sessions"
+)
+
+// Uploads are streamed into a paste as they arrive, instead of being parsed
+// out of a form, so they can be far larger than PASTE_MAXIMUM_LENGTH. The body
+// of a POST or PUT is either the paste itself or, if it's multipart/form-data,
+// a file for every file part. Options (lang, title, visibility, expire,
+// expire_at and max_views) come from the query string or from the form's
+// other parts.
+
+type PasteUploadError string
+
+func (e PasteUploadError) Error() string {
+	return string(e)
+}
+
+type PasteUploadTooLargeError int64
+
+func (e PasteUploadTooLargeError) Error() string {
+	return fmt.Sprintf("Your upload exceeds the maximum upload size, which is %v.", ByteSize(e))
+}
+
+var errUploadTooLarge = errors.New("upload too large")
+
+// uploadOptionLimit bounds each of the non-file parts of a multipart upload,
+// and uploadOverhead what a multipart upload can spend on anything but files.
+const (
+	uploadOptionLimit = 4096
+	uploadOverhead    = 64 << 10
+)
+
+// uploadLimitReader reads from r until more than n bytes have been read.
+type uploadLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *uploadLimitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errUploadTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errUploadTooLarge
+	}
+	return n, err
+}
+
+// uploadLimitWriter writes through to w until more than n bytes have been written.
+type uploadLimitWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *uploadLimitWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, errUploadTooLarge
+	}
+	l.n -= int64(len(p))
+	return l.w.Write(p)
+}
+
+// limitUploadBody caps the whole of r's body, which has to hold at most
+// uploadLimit bytes of files.
+func limitUploadBody(r *http.Request) *uploadLimitReader {
+	body := &uploadLimitReader{r: r.Body, n: arguments.uploadLimit + uploadOverhead}
+	r.Body = ioutil.NopCloser(body)
+	return body
+}
+
+// streamPasteUpload copies the request body into pw, returning the upload's
+// options and, for a multipart upload, its files.
+func streamPasteUpload(pw io.Writer, r *http.Request) (opts url.Values, files []*PasteFile, err error) {
+	body := limitUploadBody(r)
+	opts, files, err = copyPasteUpload(&uploadLimitWriter{w: pw, n: arguments.uploadLimit}, r)
+	if body.n < 0 {
+		// The multipart reader doesn't pass our error along as it was.
+		err = errUploadTooLarge
+	}
+	return
+}
+
+func copyPasteUpload(w io.Writer, r *http.Request) (opts url.Values, files []*PasteFile, err error) {
+	opts = r.URL.Query()
+
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "multipart/form-data" {
+		n, err := io.Copy(w, r.Body)
+		if err == nil && n == 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return opts, nil, err
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	taken := make(map[string]bool)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		if part.FileName() == "" {
+			value, err := ioutil.ReadAll(io.LimitReader(part, uploadOptionLimit))
+			if err != nil {
+				return nil, nil, err
+			}
+			opts.Add(part.FormName(), string(value))
+			continue
+		}
+
+		n, err := io.Copy(w, part)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// Empty files are dropped, as they are from the paste editor.
+		if n > 0 {
+			lang := LanguageForFilename(part.FileName())
+			files = append(files, &PasteFile{Name: pasteFileName(part.FileName(), len(files), lang, taken), Language: lang, Length: n})
+		}
+	}
+
+	if len(files) == 0 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return opts, files, nil
+}
+
+// pasteUploadCore streams an upload into p, leaving p untouched if anything
+// about it is wrong.
+func pasteUploadCore(p *Paste, r *http.Request, newPaste bool) {
+	if p.ClientEncryption != "" {
+		panic(PasteClientEncryptionError("Client-encrypted pastes can't be uploaded to."))
+	}
+
+	if r.ContentLength > arguments.uploadLimit+uploadOverhead {
+		panic(uploadError(errUploadTooLarge))
+	}
+
+	pw, err := p.Writer()
+	if err != nil {
+		panic(err)
+	}
+
+	opts, files, err := streamPasteUpload(pw, r)
+	if err == nil {
+		err = applyPasteUploadOptions(p, opts, files, newPaste)
+	}
+	if err != nil {
+		if aerr := pw.Abort(); aerr != nil {
+			glog.Errorf("Failed to abort upload to paste %v: %v", p.ID, aerr)
+		}
+		panic(uploadError(err))
+	}
+
+	if err := pw.Close(); err != nil { // Saves p
+		panic(err)
+	}
+}
+
+// uploadError explains err, which stopped an upload, to the uploader.
+func uploadError(err error) error {
+	switch err {
+	case errUploadTooLarge:
+		return PasteUploadTooLargeError(arguments.uploadLimit)
+	case io.ErrUnexpectedEOF:
+		return PasteUploadError("Hey, put some text in that paste.")
+	}
+	if _, ok := err.(HTTPError); ok {
+		return err
+	}
+	return PasteUploadError(err.Error())
+}
+
+func applyPasteUploadOptions(p *Paste, opts url.Values, files []*PasteFile, newPaste bool) error {
+	if files != nil {
+		p.Language = files[0].Language
+		p.Files = nil
+		if len(files) > 1 {
+			p.Files = files
+		}
+	} else if newPaste {
+		p.Files = nil
+	} else if len(p.Files) > 0 {
+		return PasteUploadError("Upload all of a multi-file paste's files as a multipart form.")
+	}
+
+	if lang := opts.Get("lang"); lang != "" && len(files) <= 1 {
+		p.Language = LanguageNamed(lang)
+	}
+	if p.Language == nil {
+		p.Language = unknownLanguage
+	}
+
+	if newPaste {
+		maxViews, err := parseMaxViews(opts.Get("max_views"))
+		if err != nil {
+			return err
+		}
+		p.MaxViews = maxViews
+	}
+
+	if title, ok := opts["title"]; ok {
+		p.Title = strings.TrimSpace(title[0])
+	}
+
+	if v := opts.Get("visibility"); v != "" || newPaste {
+		visibility, err := parsePasteVisibility(v)
+		if err != nil {
+			return err
+		}
+		p.Visibility = visibility
+	}
+
+	// An update that doesn't mention the expiration leaves it alone.
+	if expireIn, expireAt := opts.Get("expire"), opts.Get("expire_at"); newPaste || expireIn != "" || expireAt != "" {
+		if err := updatePasteExpiration(p, expireIn, expireAt, newPaste); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func pasteUpload(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+	if base := r.Header.Get("If-Match"); base != "" && !etagMatches(base, p.ETag()) {
+		w.Header().Set("ETag", p.ETag())
+		RenderError(PasteModifiedError{ID: p.ID}, http.StatusPreconditionFailed, w)
+		return
+	}
+	pasteUploadCore(p, r, false)
+
+	healthServer.IncrementMetric("paste.updated")
+	w.Header().Set("Location", pasteURL("show", p))
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// pasteUploadCreate makes a new paste out of an upload. Uploaded pastes can't
+// be given a password; that needs a form (and HTTPS.)
+func pasteUploadCreate(w http.ResponseWriter, r *http.Request) {
+	defer errorRecoveryHandler(w)
+
+	p, err := pasteStore.New(false)
+	if err != nil {
+		panic(err)
+	}
+
+	p.Owner = requestOwner(r)
+	pasteUploadCore(p, r, true)
+
+	perms := GetPastePermissions(r)
+	perms.Put(p.ID, PastePermission{"edit": true, "grant": true})
+	perms.Save(w, r)
+	if err := sessions.Save(r, w); err != nil {
+		glog.Errorln(err)
+	}
+
+	healthServer.IncrementMetric("paste.created")
+	healthServer.IncrementMetric("paste.uploaded")
+	w.Header().Set("Location", pasteURL("show", p))
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// pasteAttach attaches every file in a multipart form to a paste. If any of
+// them can't be attached, none of them are.
+func pasteAttach(o Model, w http.ResponseWriter, r *http.Request) {
+	p := o.(*Paste)
+
+	if r.ContentLength > arguments.uploadLimit+uploadOverhead {
+		panic(uploadError(errUploadTooLarge))
+	}
+
+	body := limitUploadBody(r)
+	attached, err := attachUploadedFiles(p, r)
+	if body.n < 0 {
+		err = errUploadTooLarge
+	}
+	if err != nil {
+		for _, a := range attached {
+			if derr := a.Destroy(); derr != nil {
+				glog.Errorf("Failed to remove attachment %s from paste %v: %v", a.Name, p.ID, derr)
+			}
+		}
+		panic(uploadError(err))
+	}
+
+	for _, a := range attached {
+		healthServer.IncrementMetric("paste.attachment.added")
+		glog.Infof("Attached %s (%v) to paste %v", a.Name, ByteSize(a.Length), p.ID)
+	}
+
+	if len(attached) == 1 {
+		SetFlash(w, "success", fmt.Sprintf("Attached %s to paste %v.", attached[0].Name, p.ID))
+	} else {
+		SetFlash(w, "success", fmt.Sprintf("Attached %d files to paste %v.", len(attached), p.ID))
+	}
+	w.Header().Set("Location", pasteURL("show", p))
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+func attachUploadedFiles(p *Paste, r *http.Request) (attached []*PasteAttachment, err error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, PasteUploadError("Attachments have to be uploaded as a multipart form.")
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return attached, err
+		}
+
+		// Anything but a file is skipped over by the next call to NextPart.
+		if part.FileName() == "" {
+			continue
+		}
+
+		aw, err := p.NewAttachment(part.FileName(), attachmentType(part.FileName(), part.Header.Get("Content-Type")))
+		if err != nil {
+			return attached, err
+		}
+
+		n, err := io.Copy(&uploadLimitWriter{w: aw, n: arguments.uploadLimit}, part)
+		if err != nil || n == 0 {
+			if aerr := aw.Abort(); aerr != nil {
+				glog.Errorf("Failed to abort attachment to paste %v: %v", p.ID, aerr)
+			}
+			if err != nil {
+				return attached, err
+			}
+			continue
+		}
+
+		if err := aw.Close(); err != nil {
+			return attached, err
+		}
+		attached = append(attached, aw.Attachment())
+	}
+
+	if len(attached) == 0 {
+		return nil, PasteUploadError("Choose a file to attach.")
+	}
+	return attached, nil
+}
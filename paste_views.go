@@ -0,0 +1,196 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// MAX_PASTE_VIEWS bounds the number of views a paste can be limited to.
+const MAX_PASTE_VIEWS = 1000
+
+type PasteViewLimitError string
+
+func (e PasteViewLimitError) Error() string {
+	return string(e)
+}
+
+// parseMaxViews reads the view limit requested for a new paste; a blank one
+// means no limit.
+func parseMaxViews(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n > MAX_PASTE_VIEWS {
+		return 0, PasteViewLimitError("A paste can be limited to between 1 and " + strconv.Itoa(MAX_PASTE_VIEWS) + " views.")
+	}
+	return n, nil
+}
+
+// CountView records a view of p in its store, returning how many times p has
+// been viewed, this one included. Views are counted atomically, so any number
+// of concurrent viewers each get a different count.
+func (p *Paste) CountView() (int, error) {
+	n, err := p.store.countView(p, 1)
+	if err == nil {
+		p.Views = n
+	}
+	return n, err
+}
+
+// uncountView gives back a view counted by CountView that p was never shown for.
+func (p *Paste) uncountView() error {
+	n, err := p.store.countView(p, -1)
+	if err == nil {
+		p.Views = n
+	}
+	return err
+}
+
+// RemainingViews is the number of times p can still be viewed, or -1 if it
+// isn't limited.
+func (p *Paste) RemainingViews() int {
+	if p.MaxViews == 0 {
+		return -1
+	}
+	if p.Views >= p.MaxViews {
+		return 0
+	}
+	return p.MaxViews - p.Views
+}
+
+func (store *FilesystemPasteStore) countView(p *Paste, delta int) (int, error) {
+	store.metadataLock.Lock()
+	defer store.metadataLock.Unlock()
+
+	filename := store.filenameForID(p.ID)
+	if _, err := os.Stat(filename); err != nil {
+		return 0, PasteNotFoundError{ID: p.ID}
+	}
+
+	// The whole of the metadata is written back, lest a paste still using the
+	// legacy layout lose the rest of it.
+	md, err := store.loadMetadata(filename)
+	if err != nil {
+		return 0, err
+	}
+
+	n, _ := strconv.Atoi(md["views"])
+	n += delta
+	md["views"] = strconv.Itoa(n)
+	if err := store.metadata.Store(filename, md); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (store *SQLitePasteStore) countView(p *Paste, delta int) (int, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var n int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM pastes WHERE id = ?", p.ID.String()).Scan(&n); err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, PasteNotFoundError{ID: p.ID}
+	}
+
+	if _, err := tx.Exec("INSERT OR IGNORE INTO paste_metadata (paste_id, name, value) VALUES (?, 'views', '0')", p.ID.String()); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("UPDATE paste_metadata SET value = CAST(value AS INTEGER) + ? WHERE paste_id = ? AND name = 'views'", delta, p.ID.String()); err != nil {
+		return 0, err
+	}
+
+	if err := tx.QueryRow("SELECT CAST(value AS INTEGER) FROM paste_metadata WHERE paste_id = ? AND name = 'views'", p.ID.String()).Scan(&n); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// viewGate lets any number of a view-limited paste's viewers read it at once,
+// while the one who uses up its last view waits for them to finish before
+// destroying it.
+type viewGate struct {
+	sync.RWMutex
+	refs int
+}
+
+var viewGates = struct {
+	sync.Mutex
+	gates map[PasteID]*viewGate
+}{gates: make(map[PasteID]*viewGate)}
+
+func acquireViewGate(id PasteID) *viewGate {
+	viewGates.Lock()
+	defer viewGates.Unlock()
+	g, ok := viewGates.gates[id]
+	if !ok {
+		g = &viewGate{}
+		viewGates.gates[id] = g
+	}
+	g.refs++
+	return g
+}
+
+func releaseViewGate(id PasteID) {
+	viewGates.Lock()
+	defer viewGates.Unlock()
+	g := viewGates.gates[id]
+	g.refs--
+	if g.refs == 0 {
+		delete(viewGates.gates, id)
+	}
+}
+
+// beginLimitedView counts a view of p, a view-limited paste, and holds it open
+// for reading until the returned function is called with whether p was shown
+// after all. If it wasn't, the view is given back; if it was, and this view
+// was p's last, that function destroys p once every other reader is done
+// with it.
+func beginLimitedView(p *Paste) (func(shown bool), error) {
+	g := acquireViewGate(p.ID)
+	g.RLock()
+
+	n, err := p.CountView()
+	if err == nil && n > p.MaxViews {
+		// Somebody else used up the last view, and p is (or should be) gone.
+		err = PasteNotFoundError{ID: p.ID}
+	}
+	if err != nil {
+		g.RUnlock()
+		releaseViewGate(p.ID)
+		return nil, err
+	}
+
+	return func(shown bool) {
+		g.RUnlock()
+		if !shown {
+			if err := p.uncountView(); err != nil {
+				glog.Errorf("Failed to give back a view of paste %v: %v", p.ID, err)
+			}
+		} else if n == p.MaxViews {
+			g.Lock()
+			if err := p.Destroy(); err != nil {
+				glog.Errorf("Failed to destroy paste %v after its last view: %v", p.ID, err)
+			} else {
+				healthServer.IncrementMetric("paste.views_exhausted")
+			}
+			g.Unlock()
+		}
+		releaseViewGate(p.ID)
+	}, nil
+}
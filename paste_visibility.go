@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// PasteVisibility decides who can find a paste. Unlisted pastes can be read by
+// anybody who has their link, as every paste once could. Public pastes are
+// listed (and fed) for everybody as well, and private ones can only be read by
+// whoever holds a permission for them.
+type PasteVisibility string
+
+const (
+	PasteVisibilityPublic   PasteVisibility = "public"
+	PasteVisibilityUnlisted PasteVisibility = "unlisted"
+	PasteVisibilityPrivate  PasteVisibility = "private"
+)
+
+// publicPasteListLength bounds the public listing and its feed.
+const publicPasteListLength = 50
+
+type PasteVisibilityError string
+
+func (e PasteVisibilityError) Error() string {
+	return "A paste can be public, unlisted or private, but not " + string(e) + "."
+}
+
+// parsePasteVisibility reads a visibility from a form; an empty one means unlisted.
+func parsePasteVisibility(s string) (PasteVisibility, error) {
+	switch v := PasteVisibility(s); v {
+	case PasteVisibilityPublic, PasteVisibilityUnlisted, PasteVisibilityPrivate:
+		return v, nil
+	case "":
+		return PasteVisibilityUnlisted, nil
+	}
+	return "", PasteVisibilityError(s)
+}
+
+func (p *Paste) IsPublic() bool {
+	return p.Visibility == PasteVisibilityPublic
+}
+
+func (p *Paste) IsPrivate() bool {
+	return p.Visibility == PasteVisibilityPrivate
+}
+
+// isPasteVisible reports whether r may read p at all. Admins can read private
+// pastes too, as somebody has to look into reports about them.
+func isPasteVisible(p *Paste, r *http.Request) bool {
+	return !p.IsPrivate() || isEditAllowed(p, r) || isUserAllowed("admin", r)
+}
+
+// publicPastes returns the newest public pastes.
+func publicPastes() []*Paste {
+	return pasteListing.Public(publicPasteListLength)
+}
+
+func publicPastesHandler(w http.ResponseWriter, r *http.Request) {
+	RenderPage(w, r, "public", publicPastes())
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Link    atomLink `xml:"link"`
+	Updated string   `xml:"updated"`
+	Summary string   `xml:"summary"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Links   []atomLink  `xml:"link"`
+	Updated string      `xml:"updated"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+// publicPastesFeedHandler serves the public listing as an Atom feed. Entries
+// carry a paste's title and language, but never its body.
+func publicPastesFeedHandler(w http.ResponseWriter, r *http.Request) {
+	base := BaseURLForRequest(r)
+	resolve := func(path string) string {
+		u, _ := base.Parse(path)
+		return u.String()
+	}
+
+	pastes := publicPastes()
+	feed := atomFeed{
+		Title: "Public Pastes - " + brand,
+		ID:    resolve("/public"),
+		Links: []atomLink{
+			{Href: resolve("/public")},
+			{Rel: "self", Href: resolve("/public/feed")},
+		},
+		Updated: time.Now().UTC().Format(time.RFC3339),
+	}
+	if len(pastes) > 0 {
+		feed.Updated = pastes[0].LastModified().UTC().Format(time.RFC3339)
+	}
+
+	for _, p := range pastes {
+		title := p.Title
+		if title == "" || p.ClientEncryption != "" {
+			title = "Paste " + p.ID.String()
+		}
+		link := resolve(pasteURL("show", p))
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title:   title,
+			ID:      link,
+			Link:    atomLink{Href: link},
+			Updated: p.LastModified().UTC().Format(time.RFC3339),
+			Summary: p.Language.Name,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(feed); err != nil {
+		glog.Errorln("Failed to write the public feed:", err)
+	}
+}
@@ -174,6 +174,68 @@
 					}
 				});
 			},
+			// Client-side encryption; see paste_client.go for the format. The
+			// key is carried in the URL fragment as "k=<base64url key>".
+			clientEncryption: {
+				method: "1",
+				supported: function() {
+					return !!(window.crypto && window.crypto.subtle && window.TextEncoder && window.Promise);
+				},
+				keyFromHash: function(hash) {
+					var m = (hash || "").match(/(?:^#|;)k=([A-Za-z0-9_-]+)/);
+					return m ? m[1] : undefined;
+				},
+				_toBase64: function(bytes) {
+					var s = "";
+					for(var i = 0; i < bytes.length; i++) {
+						s += String.fromCharCode(bytes[i]);
+					}
+					return btoa(s);
+				},
+				_fromBase64: function(s) {
+					var bin = atob(s), bytes = new Uint8Array(bin.length);
+					for(var i = 0; i < bin.length; i++) {
+						bytes[i] = bin.charCodeAt(i);
+					}
+					return bytes;
+				},
+				_importKey: function(key) {
+					var b64 = key.replace(/-/g, "+").replace(/_/g, "/");
+					while(b64.length % 4 !== 0) b64 += "=";
+					return window.crypto.subtle.importKey("raw", this._fromBase64(b64), {name: "AES-GCM"}, false, ["encrypt", "decrypt"]);
+				},
+				generateKey: function() {
+					var self = this;
+					return window.crypto.subtle.generateKey({name: "AES-GCM", length: 256}, true, ["encrypt", "decrypt"]).then(function(key) {
+						return window.crypto.subtle.exportKey("raw", key);
+					}).then(function(raw) {
+						return self._toBase64(new Uint8Array(raw)).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+					});
+				},
+				encrypt: function(key, doc) {
+					var self = this;
+					var iv = window.crypto.getRandomValues(new Uint8Array(12));
+					return this._importKey(key).then(function(cryptoKey) {
+						return window.crypto.subtle.encrypt({name: "AES-GCM", iv: iv}, cryptoKey, new TextEncoder().encode(JSON.stringify(doc)));
+					}).then(function(sealed) {
+						var out = new Uint8Array(iv.length + sealed.byteLength);
+						out.set(iv);
+						out.set(new Uint8Array(sealed), iv.length);
+						return self._toBase64(out);
+					});
+				},
+				decrypt: function(key, ciphertext) {
+					var self = this, raw;
+					return Promise.resolve().then(function() {
+						raw = self._fromBase64(ciphertext);
+						return self._importKey(key);
+					}).then(function(cryptoKey) {
+						return window.crypto.subtle.decrypt({name: "AES-GCM", iv: raw.subarray(0, 12)}, cryptoKey, raw.subarray(12));
+					}).then(function(plain) {
+						return JSON.parse(new TextDecoder().decode(plain));
+					});
+				},
+			},
 			displayFlash: function(flash) {
 				var container = $("#flash-container");
 				var newFlash = container.find("#flash-template").clone();
@@ -202,7 +264,10 @@ $(function() {
 	"use strict";
 
 	var pasteForm = $("#pasteForm");
-	var code = $("#code"), codeeditor = $("#code-editor");
+	var code = $("#code");
+	var codeeditor = function() {
+		return $("#pasteForm .paste-file.active textarea.code-editor");
+	};
 	if(pasteForm.length > 0) {
 		// Initialize the form.
 		var langbox = pasteForm.find("#langbox");
@@ -223,10 +288,22 @@ $(function() {
 				return false;
 			},
 		});
-		var lang = Spectre.languageNamed(langbox.data("selected")) ||
+		var activeLanguageInput = function() {
+			return pasteForm.find(".paste-file.active input[name='lang']");
+		};
+		var lang = Spectre.languageNamed(activeLanguageInput().val()) ||
 				Spectre.defaultLanguage() ||
 				Spectre.languageNamed("text");
 		langbox.select2("data", lang);
+		activeLanguageInput().val(lang.id);
+
+		// The language box always shows (and changes) the language of the file being edited.
+		langbox.on("change", function() {
+			activeLanguageInput().val(langbox.select2("val"));
+		});
+		pasteForm.on("file-activated", function() {
+			langbox.select2("data", Spectre.languageNamed(activeLanguageInput().val()) || Spectre.languageNamed("text"));
+		});
 
 		if(context === "new") {
 			pasteForm.find("input[name='expire']").val(Spectre.defaultExpiration());
@@ -245,10 +322,15 @@ $(function() {
 			});
 		}
 		pasteForm.on('submit', function() {
-			if((codeeditor.val().match(/[^\s]/)||[]).length !== 0) {
+			var editors = pasteForm.find("textarea.code-editor:enabled");
+			if(editors.filter(function() { return /[^\s]/.test(this.value); }).length !== 0) {
 				if(context === "new") {
+					var expiration = pasteForm.find("input[name='expire']").val();
 					if(Spectre.getPreference("saveExpiration", "false") === "true") {
-						Spectre.setDefaultExpiration(pasteForm.find("input[name='expire']").val());
+						// Burning every paste after reading is never what anybody wants by default.
+						if(expiration !== "burn") {
+							Spectre.setDefaultExpiration(expiration);
+						}
 					} else {
 						Spectre.clearDefaultExpiration();
 					}
@@ -260,6 +342,9 @@ $(function() {
 					}
 				}
 				pasteForm.find("input[name='title']").val($("#editable-paste-title").text())
+				pasteForm.find("#paste-file-tabs .paste-file-tab:not(#paste-file-tab-template)").each(function(i) {
+					pasteForm.find(".paste-file:not(#paste-file-template) input[name='filename']").eq(i).val($(this).find(".paste-file-name").text());
+				});
 			} else {
 				$("#deleteModal, #emptyPasteModal").modal("show");
 				return false;
@@ -267,13 +352,79 @@ $(function() {
 		});
 		$("#editable-paste-title").keypress(function(e) {
 			if(e.which == 13) {
-				$(codeeditor).focus();
+				codeeditor().focus();
 				return false;
 			}
 			return true;
 		});
 	}
 
+	(function(){
+		var tabs = $("#paste-file-tabs");
+		if(tabs.length === 0) return;
+
+		var wrapper = pasteForm.find(".textarea-height-wrapper");
+		var tabTemplate = $("#paste-file-tab-template"), fileTemplate = $("#paste-file-template");
+		var allTabs = function() {
+			return tabs.children(".paste-file-tab").not(tabTemplate);
+		};
+		var allFiles = function() {
+			return wrapper.children(".paste-file").not(fileTemplate);
+		};
+
+		// Tabs and files are kept in the same order; a tab's position finds its file.
+		var activate = function(tab) {
+			var i = allTabs().index(tab);
+			allTabs().removeClass("active").eq(i).addClass("active");
+			allFiles().removeClass("active").eq(i).addClass("active");
+			pasteForm.trigger("file-activated");
+		};
+
+		var updateMultiFile = function() {
+			pasteForm.toggleClass("multi-file", allFiles().length > 1);
+		};
+
+		tabs.on("click", ".paste-file-tab", function() {
+			if(!$(this).hasClass("active")) {
+				activate(this);
+			}
+		});
+
+		tabs.on("click", ".paste-file-remove", function() {
+			var tab = $(this).closest(".paste-file-tab");
+			var wasActive = tab.hasClass("active");
+			allFiles().eq(allTabs().index(tab)).remove();
+			tab.remove();
+			if(wasActive) {
+				activate(allTabs().first());
+			}
+			updateMultiFile();
+			return false;
+		});
+
+		tabs.on("keypress", ".paste-file-name", function(e) {
+			if(e.which == 13) {
+				codeeditor().focus();
+				return false;
+			}
+			return true;
+		});
+
+		$("#addFileButton").on("click", function() {
+			var lang = pasteForm.find("#langbox").select2("val");
+			var file = fileTemplate.clone().removeAttr("id");
+			file.find("input, textarea").prop("disabled", false);
+			file.find("input[name='lang']").val(lang);
+			file.appendTo(wrapper);
+
+			var tab = tabTemplate.clone().removeAttr("id").removeClass("hide");
+			tab.insertBefore(tabTemplate);
+
+			updateMultiFile();
+			activate(tab);
+			tab.find(".paste-file-name").focus();
+		});
+	})();
 	(function(){
 		var controls = $("#paste-controls");
 		if(controls.length === 0) return;
@@ -295,7 +446,13 @@ $(function() {
 
 		encModal.modal({show: false});
 		var	modalPasswordField = encModal.find("input[type='password']"),
-			pastePasswordField = pasteForm.find("input[name='password']");
+			pastePasswordField = pasteForm.find("input[name='password']"),
+			clientCheckbox = $("#clientEncryptionOption input"),
+			clientMethodField = pasteForm.find("input[name='client_encryption']");
+
+		if(Spectre.clientEncryption.supported()) {
+			$("#clientEncryptionOption").removeClass("hide");
+		}
 
 		modalPasswordField.keypress(function(e) {
 			if(e.which === 13) {
@@ -304,18 +461,30 @@ $(function() {
 			}
 		});
 
-		var setEncrypted = function(encrypted) {
-			$("#encryptionIcon").removeClass("icon-lock icon-lock-open-alt").addClass(encrypted ? "icon-lock" : "icon-lock-open-alt");
-			$("#encryptionButton .button-data-label").text(encrypted ? "On" : "");
+		clientCheckbox.on("change", function() {
+			modalPasswordField.prop("disabled", this.checked);
+		});
+
+		var setEncrypted = function(label) {
+			$("#encryptionIcon").removeClass("icon-lock icon-lock-open-alt").addClass(label ? "icon-lock" : "icon-lock-open-alt");
+			$("#encryptionButton .button-data-label").text(label);
 		};
 
 		encModal.on("show", function() {
 			modalPasswordField.val(pastePasswordField.val());
+			clientCheckbox.prop("checked", clientMethodField.val() !== "").triggerHandler("change");
 		}).on("shown", function() {
 			$(this).find("input").eq(0).focus().select();
 		}).on("hidden", function() {
-			pastePasswordField.val(modalPasswordField.val());
-			setEncrypted($(this).find("input").val().length > 0);
+			if(clientCheckbox.prop("checked")) {
+				clientMethodField.val(Spectre.clientEncryption.method);
+				pastePasswordField.val("");
+				setEncrypted("Browser");
+			} else {
+				clientMethodField.val("");
+				pastePasswordField.val(modalPasswordField.val());
+				setEncrypted(modalPasswordField.val().length > 0 ? "On" : "");
+			}
 		});
 
 		$("#encryptionButton").on("click", function() {
@@ -331,23 +500,207 @@ $(function() {
 		var expInput = pasteForm.find("input[name='expire']");
 		var expDataLabel = $("#expirationButton .button-data-label");
 
+		var maxViewsInput = expModal.find("input[name='max_views']");
+		var expAtField = pasteForm.find("input[name='expire_at']");
+		var expAtInput = $("#expireAtInput");
+
+		// datetime-local inputs take (and give) the local time, without a zone.
+		var localDateTime = function(date) {
+			var pad = function(n) { return (n < 10 ? "0" : "") + n; };
+			return date.getFullYear() + "-" + pad(date.getMonth() + 1) + "-" + pad(date.getDate()) +
+				"T" + pad(date.getHours()) + ":" + pad(date.getMinutes());
+		};
+		if(expAtInput.data("value")) {
+			expAtInput.val(localDateTime(new Date(expAtInput.data("value"))));
+		}
+
+		var updateExpirationLabel = function() {
+			var labels = [];
+			var selected = expModal.find("button[data-value].active");
+			if(selected.data("display-value")) labels.push(selected.data("display-value"));
+			if(expAtInput.val()) labels.push(expAtInput.val().replace("T", " "));
+			if(maxViewsInput.val()) labels.push(maxViewsInput.val() + " views");
+			expDataLabel.text(labels.join(", "));
+		};
+
 		var setExpirationSelected = function() {
 			$(this).button('toggle');
 			expInput.val($(this).data("value"));
-			expDataLabel.text($(this).data("display-value"));
+			expAtField.val("");
+			expAtInput.val("");
+			updateExpirationLabel();
 		};
 
-		setExpirationSelected.call(expModal.find("button[data-value='"+expInput.val()+"']"));
+		var initialExpiration = expModal.find("button[data-value='"+expInput.val()+"']");
+		if(initialExpiration.length > 0) {
+			setExpirationSelected.call(initialExpiration);
+		} else {
+			updateExpirationLabel();
+		}
 		expModal.find("button[data-value]").on("click", function() {
 			setExpirationSelected.call(this);
 			expModal.modal("hide");
 		});
+		maxViewsInput.on("input change", updateExpirationLabel);
+		expAtInput.on("change", function() {
+			var when = new Date(this.value);
+			if(!this.value || isNaN(when.getTime())) {
+				expAtField.val("");
+			} else {
+				// Only an expiration time that's actually been chosen is sent.
+				expAtField.val(when.toISOString());
+				expInput.val("");
+				expModal.find("button[data-value].active").removeClass("active");
+			}
+			updateExpirationLabel();
+		});
 
 		$("#expirationButton").on("click", function() {
 			expModal.modal("show");
 		});
 	})();
 
+	(function(){
+		var visModal = $("#visibilityModal");
+		if(visModal.length === 0) return;
+
+		visModal.modal({show: false});
+
+		var visInput = pasteForm.find("input[name='visibility']");
+		var visDataLabel = $("#visibilityButton .button-data-label");
+
+		var setVisibilitySelected = function() {
+			$(this).button('toggle');
+			visInput.val($(this).data("value"));
+			visDataLabel.text($(this).data("display-value"));
+		};
+
+		setVisibilitySelected.call(visModal.find("button[data-value='"+visInput.val()+"']"));
+		visModal.find("button[data-value]").on("click", function() {
+			setVisibilitySelected.call(this);
+			visModal.modal("hide");
+		});
+
+		$("#visibilityButton").on("click", function() {
+			visModal.modal("show");
+		});
+	})();
+
+	(function(){
+		var clientMethodField = pasteForm.find("input[name='client_encryption']");
+		if(clientMethodField.length === 0) return;
+
+		var ce = Spectre.clientEncryption;
+		var key = ce.keyFromHash(window.location.hash);
+		var saveButton = pasteForm.find("button[type='submit']");
+
+		if(pasteForm.data("client-encryption")) {
+			// Decrypt the paste into the editor; without its key, it can't be saved.
+			var editor = codeeditor();
+			var ciphertext = editor.val();
+			editor.val("");
+			saveButton.prop("disabled", true);
+			$("#addFileButton").hide();
+
+			var failed = function() {
+				Spectre.displayFlash({type: "error", body: "This paste can't be edited without the key from its link."});
+			};
+			if(!key || !ce.supported()) {
+				failed();
+				return;
+			}
+
+			ce.decrypt(key, ciphertext).then(function(doc) {
+				editor.val(doc.body);
+				$("#editable-paste-title").text(doc.title || "");
+				var lang = Spectre.languageNamed(doc.language) || Spectre.languageNamed("text");
+				pasteForm.find(".paste-file.active input[name='lang']").val(lang.id);
+				pasteForm.trigger("file-activated");
+				saveButton.prop("disabled", false);
+			}, failed);
+		}
+
+		// The body, title and language are encrypted and sent in place of
+		// the editor's contents, and the key is put in the fragment of the
+		// URL we're sent back to.
+		pasteForm.on("submit", function(e) {
+			if(e.isDefaultPrevented() || clientMethodField.val() === "") return;
+
+			var files = pasteForm.find(".paste-file").not("#paste-file-template");
+			if(files.length > 1) {
+				Spectre.displayFlash({type: "error", body: "Pastes encrypted in your browser can only have one file."});
+				return false;
+			}
+
+			var doc = {
+				title: $("#editable-paste-title").text(),
+				language: files.find("input[name='lang']").val(),
+				body: files.find("textarea").val(),
+			};
+
+			saveButton.prop("disabled", true);
+			(key ? Promise.resolve(key) : ce.generateKey()).then(function(newKey) {
+				key = newKey;
+				return ce.encrypt(key, doc);
+			}).then(function(ciphertext) {
+				files.find("input, textarea").prop("disabled", true);
+				pasteForm.find("input[name='title'], input[name='password']").val("");
+				$(document.createElement("input")).attr({type: "hidden", name: "text"}).val(ciphertext).appendTo(pasteForm);
+				pasteForm.attr("action", pasteForm.attr("action").split("#")[0] + "#k=" + key);
+				pasteForm.get(0).submit();
+			}, function() {
+				saveButton.prop("disabled", false);
+				Spectre.displayFlash({type: "error", body: "Your browser couldn't encrypt this paste."});
+			});
+			return false;
+		});
+	})();
+	(function(){
+		var encrypted = code.filter("[data-ciphertext]");
+		if(encrypted.length === 0) return;
+
+		var ce = Spectre.clientEncryption;
+		var key = ce.keyFromHash(window.location.hash);
+		var failed = function(reason) {
+			encrypted.empty().append($(document.createElement("em")).text(reason));
+		};
+
+		if(!key) {
+			failed("This paste was encrypted in its author's browser, and the key from its link is missing.");
+			return;
+		}
+		if(!ce.supported()) {
+			failed("This paste was encrypted in its author's browser, and yours can't decrypt it.");
+			return;
+		}
+
+		// Links and forms that lead elsewhere on this paste carry its key along.
+		var pastePath = window.location.pathname.split("/").slice(0, 3).join("/");
+		$("a[href='"+pastePath+"'], a[href^='"+pastePath+"/']").each(function() {
+			this.hash = "k="+key;
+		});
+		$("form[action^='"+pastePath+"/']").each(function() {
+			$(this).attr("action", $(this).attr("action").split("#")[0] + "#k=" + key);
+		});
+
+		ce.decrypt(key, encrypted.attr("data-ciphertext")).then(function(doc) {
+			encrypted.text(doc.body);
+			if(doc.title) {
+				$("#paste-title").text(doc.title);
+			}
+			if(!Spectre.languagesForSelect2()) {
+				Spectre.loadLanguages();
+			}
+			var lang = Spectre.languageNamed(doc.language);
+			if(lang) {
+				$("#paste-language").text(lang.name);
+			}
+			encrypted.trigger("code-changed");
+		}, function() {
+			failed("This paste couldn't be decrypted with the key from its link.");
+		});
+	})();
+
 	// Common for the following functions.
 	var lineNumberTrough = $("#line-numbers");
 
@@ -372,52 +725,70 @@ $(function() {
 					.show();
 			};
 
+			// A client-encrypted paste's key shares the fragment with the selected line.
+			var hashWithLine = function(line) {
+				var key = Spectre.clientEncryption.keyFromHash(window.location.hash);
+				var parts = key ? ["k="+key] : [];
+				if(typeof line !== 'undefined') parts.push("L"+line);
+				return "#"+parts.join(";");
+			};
+
 			var setSelectedLineNumber = function(line) {
 				if(typeof line !== 'undefined') {
 					permabar.data("cur-line", line);
-					history.replaceState({"line":line}, "", "#L"+line);
+					history.replaceState({"line":line}, "", hashWithLine(line));
 				} else {
 					permabar.removeData("cur-line");
-					history.replaceState(null, "", "#");
+					history.replaceState(null, "", hashWithLine(undefined));
 				}
 			};
 
 			var lineFromHash = function(hash) {
 				if(!hash) return undefined;
-				var v = hash.match(/^#L(\d+)/);
+				var v = hash.match(/(?:^#|;)L(\d+)/);
 				if(typeof v !== 'undefined' && v.length > 0) {
 					return v[1];
 				}
 				return undefined;
 			};
 
-			lineNumberTrough.fillWithLineNumbers((code.text().match(/\n/g)||[]).length+1, function() {
-				lineNumberTrough.children().mouseenter(function() {
-					positionLinebar.call(this, linebar);
-				}).mouseleave(function() {
-					linebar.hide();
-				}).click(function() {
-					var line = $(this).text();
-					if((0+permabar.data("cur-line")) === line) {
-						setSelectedLineNumber(undefined);
-						permabar.hide();
-						return;
+			var selectLineFromHash = function() {
+				var n = lineFromHash(window.location.hash);
+				if(n) {
+					var linespan = $("span:nth-child("+n+")", lineNumberTrough);
+					if(linespan.length > 0) {
+						setSelectedLineNumber(n);
+						positionLinebar.call(linespan.get(0), permabar);
+						linespan.scrollMinimal();
 					}
-					setSelectedLineNumber(line);
-					positionLinebar.call(this, permabar);
-				});
+				}
+			};
 
-				$(window).on("load popstate", function() {
-					var n = lineFromHash(window.location.hash);
-					if(n) {
-						var linespan = $("span:nth-child("+n+")", lineNumberTrough);
-						if(linespan.length > 0) {
-							setSelectedLineNumber(n);
-							positionLinebar.call(linespan.get(0), permabar);
-							linespan.scrollMinimal();
+			var numberLines = function() {
+				lineNumberTrough.fillWithLineNumbers((code.text().match(/\n/g)||[]).length+1, function() {
+					lineNumberTrough.children().mouseenter(function() {
+						positionLinebar.call(this, linebar);
+					}).mouseleave(function() {
+						linebar.hide();
+					}).click(function() {
+						var line = $(this).text();
+						if((0+permabar.data("cur-line")) === line) {
+							setSelectedLineNumber(undefined);
+							permabar.hide();
+							return;
 						}
-					}
+						setSelectedLineNumber(line);
+						positionLinebar.call(this, permabar);
+					});
 				});
+			};
+
+			numberLines();
+			$(window).on("load popstate", selectLineFromHash);
+			// Client-encrypted pastes only have their text once they've been decrypted.
+			code.on("code-changed", function() {
+				numberLines();
+				selectLineFromHash();
 			});
 			$(window).on("resize", function() {
 				$(linebar).width(code.outerWidth());
@@ -426,20 +797,21 @@ $(function() {
 			$(document).on("media-query-changed", function() {
 				positionLinebar.call($("span:nth-child("+permabar.data("cur-line")+")", lineNumberTrough).get(0), permabar);
 			});
-		} else if(codeeditor.length > 0) {
-			codeeditor.on("input propertychange", function() {
-				lineNumberTrough.fillWithLineNumbers((codeeditor.val().match(/\n/g)||[]).length+1, function() {
+		} else if(codeeditor().length > 0) {
+			var numberEditorLines = function() {
+				lineNumberTrough.fillWithLineNumbers((codeeditor().val().match(/\n/g)||[]).length+1, function() {
 					$(".textarea-height-wrapper").css("left", lineNumberTrough.outerWidth());
 				});
-			}).triggerHandler("input");
-			$(document).on("media-query-changed", function() {
-				codeeditor.triggerHandler("input");
-			});
+			};
+			pasteForm.on("input propertychange", "textarea.code-editor", numberEditorLines);
+			pasteForm.on("file-activated", numberEditorLines);
+			numberEditorLines();
+			$(document).on("media-query-changed", numberEditorLines);
 		}
 	})();
 	(function(){
-		if(codeeditor.length > 0) {
-			codeeditor.keydown(function(e) {
+		if(codeeditor().length > 0) {
+			pasteForm.on("keydown", "textarea.code-editor", function(e) {
 				if(e.keyCode === 9 && !e.ctrlKey && !e.altKey && !e.shiftKey) {
 					var ends = [this.selectionStart, this.selectionEnd];
 					this.value = this.value.substring(0, ends[0]) + "\t" + this.value.substring(ends[1], this.value.length);
@@ -453,7 +825,7 @@ $(function() {
 			});
 
 			var changed = false;
-			codeeditor.on("input propertychange", function() {
+			pasteForm.on("input propertychange", "textarea.code-editor", function() {
 				changed = true;
 			});
 
@@ -198,6 +198,9 @@ func (b ByteSize) String() string {
 
 var environment string = EnvironmentDevelopment
 
+// brand is the site's name, as shown to its users.
+var brand string
+
 func Env() string {
 	return environment
 }
@@ -208,7 +211,7 @@ func init() {
 		environment = EnvironmentDevelopment
 	}
 
-	brand := os.Getenv("SPECTRE_BRAND")
+	brand = os.Getenv("SPECTRE_BRAND")
 	if brand == "" {
 		brand = SPECTRE_DEFAULT_BRAND
 	}